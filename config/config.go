@@ -0,0 +1,333 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"slices"
+)
+
+const (
+	defaultShutdownTimeout  = 30 // seconds
+	defaultThumbConcurrency = 2
+	defaultThumbQuality     = 85
+	defaultThumbTimeout     = 300  // seconds
+	defaultThumbMemory      = 2048 // MB
+	defaultWatermarkOpacity = 0.5
+	defaultWatermarkScale   = 0.25
+)
+
+var defaultImageSizes = []int{320, 640, 1280, 1920, 2560, 3840}
+
+// profiles the frontend relies on, which thumb_profiles may redefine
+var defaultThumbProfiles = map[string]ThumbProfile{
+	"big":   {Size: 1000, Quality: 97, Format: "jpeg", Upscale: true, Color: "srgb"},
+	"small": {Size: 200, Crop: "centre", Quality: 97, Format: "jpeg", Upscale: true, Color: "srgb"},
+}
+
+// profile names end up in thumb names and URLs
+var thumbProfileNameRe = regexp.MustCompile(`^[a-z0-9@-]+$`)
+
+var thumbFormatExts = map[string]string{
+	"jpeg": ".jpg",
+	"webp": ".webp",
+	"avif": ".avif",
+}
+
+// ThumbProfile describes how a thumb is rendered. Empty fields are left out
+// of the JSON that Version is computed from, so that adding fields does not
+// change the version of existing profiles.
+type ThumbProfile struct {
+	Size         int    `json:"size"`                    // of the longest side, or of both if cropped
+	Crop         string `json:"crop,omitempty"`          // "" to fit, or "centre", "attention" or "entropy"
+	Quality      int    `json:"quality,omitempty"`       // 1-100, by default 85
+	Format       string `json:"format,omitempty"`        // "jpeg" (the default), "webp" or "avif"
+	Upscale      bool   `json:"upscale,omitempty"`       // enlarge photos smaller than Size
+	Sharpen      bool   `json:"sharpen,omitempty"`       // after resizing
+	KeepMetadata bool   `json:"keep_metadata,omitempty"` // do not strip EXIF and ICC data
+	Color        string `json:"color,omitempty"`         // "srgb" to convert or "keep" the ICC profile
+
+	// formats to also render in, served to browsers that accept them
+	Variants []string `json:"variants,omitempty"`
+}
+
+// Version returns a short digest of the profile, which changes whenever the
+// profile does. Variants do not affect the thumbs of other formats, so they
+// are left out.
+func (p ThumbProfile) Version() string {
+	p.Variants = nil
+	b, _ := json.Marshal(p)
+	return fmt.Sprintf("%x", sha256.Sum256(b))[:8]
+}
+
+// Ext returns the file extension of the profile format
+func (p ThumbProfile) Ext() string {
+	return thumbFormatExts[p.Format]
+}
+
+// FormatExt returns the file extension of a thumb format ("jpeg", "webp" or
+// "avif")
+func FormatExt(format string) string {
+	return thumbFormatExts[format]
+}
+
+func (p *ThumbProfile) validate(name string) error {
+	if !thumbProfileNameRe.MatchString(name) {
+		return fmt.Errorf("invalid thumb profile name %q", name)
+	}
+	if p.Size <= 0 {
+		return fmt.Errorf("thumb profile %s: invalid size %d", name, p.Size)
+	}
+	switch p.Crop {
+	case "", "centre", "attention", "entropy":
+	default:
+		return fmt.Errorf("thumb profile %s: unknown crop mode %q", name, p.Crop)
+	}
+	if p.Quality == 0 {
+		p.Quality = defaultThumbQuality
+	} else if p.Quality < 1 || p.Quality > 100 {
+		return fmt.Errorf("thumb profile %s: invalid quality %d", name, p.Quality)
+	}
+	if p.Format == "" {
+		p.Format = "jpeg"
+	} else if _, ok := thumbFormatExts[p.Format]; !ok {
+		return fmt.Errorf("thumb profile %s: unknown format %q", name, p.Format)
+	}
+	if p.Color == "" {
+		p.Color = "srgb"
+	} else if p.Color != "srgb" && p.Color != "keep" {
+		return fmt.Errorf("thumb profile %s: unknown color mode %q", name, p.Color)
+	}
+	for _, format := range p.Variants {
+		if _, ok := thumbFormatExts[format]; !ok || format == p.Format {
+			return fmt.Errorf("thumb profile %s: invalid variant %q", name, format)
+		}
+	}
+	return nil
+}
+
+// validateGo checks that the built-in thumbnailer can render the thumbs of a
+// profile, as it only writes JPEG and cannot keep metadata
+func (p ThumbProfile) validateGo(name string) error {
+	if p.Format != "jpeg" || len(p.Variants) > 0 {
+		return fmt.Errorf("thumb profile %s: the go thumbnailer only writes jpeg", name)
+	}
+	if p.KeepMetadata {
+		return fmt.Errorf("thumb profile %s: the go thumbnailer cannot keep metadata", name)
+	}
+	return nil
+}
+
+var watermarkPositions = []string{"centre", "top-left", "top-right", "bottom-left", "bottom-right"}
+
+// Watermark is overlaid on the thumbs of the listed profiles and, if Shares
+// is set, on all thumbs and images served through share links
+type Watermark struct {
+	Image    string   `json:"image,omitempty"`    // PNG or JPEG file
+	Text     string   `json:"text,omitempty"`     // drawn if there is no image
+	Position string   `json:"position,omitempty"` // "centre", "top-left" etc., by default "bottom-right"
+	Opacity  float64  `json:"opacity,omitempty"`  // 0-1
+	Scale    float64  `json:"scale,omitempty"`    // width relative to the thumb
+	Profiles []string `json:"profiles,omitempty"`
+	Shares   bool     `json:"shares,omitempty"`
+
+	version string
+}
+
+// Version returns a short digest of the watermark and its image, which
+// changes whenever they do
+func (w *Watermark) Version() string {
+	return w.version
+}
+
+func (w *Watermark) validate(profiles map[string]ThumbProfile) error {
+	if w.Image == "" && w.Text == "" {
+		return errors.New("watermark: image or text required")
+	}
+	if w.Position == "" {
+		w.Position = "bottom-right"
+	} else if !slices.Contains(watermarkPositions, w.Position) {
+		return fmt.Errorf("watermark: unknown position %q", w.Position)
+	}
+	if w.Opacity == 0 {
+		w.Opacity = defaultWatermarkOpacity
+	} else if w.Opacity < 0 || w.Opacity > 1 {
+		return fmt.Errorf("watermark: invalid opacity %g", w.Opacity)
+	}
+	if w.Scale == 0 {
+		w.Scale = defaultWatermarkScale
+	} else if w.Scale < 0 || w.Scale > 1 {
+		return fmt.Errorf("watermark: invalid scale %g", w.Scale)
+	}
+	for _, name := range w.Profiles {
+		if _, ok := profiles[name]; !ok {
+			return fmt.Errorf("watermark: unknown thumb profile %q", name)
+		}
+	}
+
+	h := sha256.New()
+	json.NewEncoder(h).Encode([]interface{}{w.Text, w.Position, w.Opacity, w.Scale})
+	if w.Image != "" {
+		image, err := os.ReadFile(w.Image)
+		if err != nil {
+			return fmt.Errorf("watermark: %w", err)
+		}
+		h.Write(image)
+	}
+	w.version = fmt.Sprintf("%x", h.Sum(nil))[:8]
+
+	return nil
+}
+
+// Privacy decides what photo JSON reveals. Viewers of share links count as
+// anonymous, like everyone when authentication is disabled.
+type Privacy struct {
+	Path string `json:"path"` // "absolute", "relative" (to a library root) or "none", for everyone
+	GPS  string `json:"gps"`  // "users" (logged-in users only) or "everyone"
+}
+
+type Config struct {
+	Database        string   `json:"database"`
+	Listen          string   `json:"listen"`
+	Socket          string   `json:"socket"`
+	TLSCert         string   `json:"tls_cert"`
+	TLSKey          string   `json:"tls_key"`
+	ShutdownTimeout int      `json:"shutdown_timeout"` // seconds
+	Auth            bool     `json:"auth"`             // require users to log in
+	LibraryRoots    []string `json:"library_roots"`    // scanned directories
+	Privacy         Privacy  `json:"privacy"`
+
+	// "vips", "go" or "auto", which uses vips if vipsthumbnail is installed
+	Thumbnailer string `json:"thumbnailer"`
+
+	// thumbs to generate in addition to big and small, which can also be
+	// redefined here
+	ThumbProfiles map[string]ThumbProfile `json:"thumb_profiles"`
+
+	// how many thumbs the server may generate on demand at the same time
+	ThumbConcurrency int `json:"thumb_concurrency"`
+
+	// how many photos thyme thumbs works on at the same time, by default as
+	// many as there are CPUs
+	ThumbWorkers int `json:"thumb_workers"`
+
+	// megabytes of decoded photos thyme thumbs may hold at the same time
+	ThumbMemory int `json:"thumb_memory"`
+
+	// seconds after which generating the thumbs of a photo is given up
+	ThumbTimeout int `json:"thumb_timeout"`
+
+	// run thyme thumbs with the lowest CPU and disk priority
+	ThumbLowPriority bool `json:"thumb_low_priority"`
+
+	// widths and heights /photos/{id}/image may be asked to resize to
+	ImageSizes []int `json:"image_sizes"`
+
+	Watermark *Watermark `json:"watermark"` // none if nil
+}
+
+// Path returns the location of the configuration file, which can be
+// overridden with the THYME_CONFIG environment variable
+func Path() string {
+	if configPath := os.Getenv("THYME_CONFIG"); configPath != "" {
+		return configPath
+	}
+	return path.Join(os.Getenv("HOME"), ".thyme.json")
+}
+
+// Load reads the configuration file, falling back to defaults for missing
+// settings or a missing file
+func Load() (*Config, error) {
+	cfg := &Config{}
+
+	f, err := os.Open(Path())
+	if err == nil {
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(cfg); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if cfg.Database == "" {
+		cfg.Database = path.Join(os.Getenv("HOME"), ".thyme.db")
+	}
+
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	if cfg.Thumbnailer == "" {
+		cfg.Thumbnailer = "auto"
+	}
+
+	if cfg.ThumbConcurrency <= 0 {
+		cfg.ThumbConcurrency = defaultThumbConcurrency
+	}
+
+	if cfg.ThumbWorkers <= 0 {
+		cfg.ThumbWorkers = runtime.NumCPU()
+	}
+
+	if cfg.ThumbMemory <= 0 {
+		cfg.ThumbMemory = defaultThumbMemory
+	}
+
+	if cfg.ThumbTimeout <= 0 {
+		cfg.ThumbTimeout = defaultThumbTimeout
+	}
+
+	profiles := map[string]ThumbProfile{}
+	for name, profile := range defaultThumbProfiles {
+		profiles[name] = profile
+	}
+	for name, profile := range cfg.ThumbProfiles {
+		if err := profile.validate(name); err != nil {
+			return nil, err
+		}
+		profiles[name] = profile
+	}
+	cfg.ThumbProfiles = profiles
+
+	if cfg.Thumbnailer == "go" {
+		for name, profile := range profiles {
+			if err := profile.validateGo(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if cfg.Watermark != nil {
+		if err := cfg.Watermark.validate(profiles); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cfg.ImageSizes) == 0 {
+		cfg.ImageSizes = defaultImageSizes
+	}
+
+	switch cfg.Privacy.Path {
+	case "":
+		cfg.Privacy.Path = "relative"
+	case "absolute", "relative", "none":
+	default:
+		return nil, fmt.Errorf("unknown privacy path %q", cfg.Privacy.Path)
+	}
+
+	switch cfg.Privacy.GPS {
+	case "":
+		cfg.Privacy.GPS = "users"
+	case "users", "everyone":
+	default:
+		return nil, fmt.Errorf("unknown privacy gps %q", cfg.Privacy.GPS)
+	}
+
+	return cfg, nil
+}
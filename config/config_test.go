@@ -0,0 +1,73 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// load loads the configuration from a file with the given JSON settings
+func load(t *testing.T, settings string) (*Config, error) {
+	path := filepath.Join(t.TempDir(), "thyme.json")
+	if err := os.WriteFile(path, []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("THYME_CONFIG", path)
+	return Load()
+}
+
+func TestLoadPrivacy(t *testing.T) {
+	tests := []struct {
+		settings string
+		path     string
+		gps      string
+		err      string
+	}{
+		{`{}`, "relative", "users", ""},
+		{`{"privacy": {"path": "absolute", "gps": "everyone"}}`, "absolute", "everyone", ""},
+		{`{"privacy": {"path": "none"}}`, "none", "users", ""},
+		{`{"privacy": {"path": "full"}}`, "", "", `unknown privacy path "full"`},
+		{`{"privacy": {"gps": "all"}}`, "", "", `unknown privacy gps "all"`},
+		{`{"privacy": {"path": "Relative"}}`, "", "", `unknown privacy path "Relative"`},
+	}
+	for _, tt := range tests {
+		cfg, err := load(t, tt.settings)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %q", tt.settings, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.settings, err)
+			continue
+		}
+		if cfg.Privacy.Path != tt.path || cfg.Privacy.GPS != tt.gps {
+			t.Errorf("%s: got %+v", tt.settings, cfg.Privacy)
+		}
+	}
+}
+
+func TestLoadGoThumbnailer(t *testing.T) {
+	tests := []struct {
+		settings string
+		err      string
+	}{
+		{`{"thumbnailer": "go"}`, ""},
+		{`{"thumbnailer": "go", "thumb_profiles": {"small": {"size": 200, "color": "keep"}}}`, ""},
+		{`{"thumbnailer": "go", "thumb_profiles": {"tiny": {"size": 50, "format": "webp"}}}`,
+			"thumb profile tiny: the go thumbnailer only writes jpeg"},
+		{`{"thumbnailer": "go", "thumb_profiles": {"big": {"size": 1000, "variants": ["avif"]}}}`,
+			"thumb profile big: the go thumbnailer only writes jpeg"},
+		{`{"thumbnailer": "go", "thumb_profiles": {"big": {"size": 1000, "keep_metadata": true}}}`,
+			"thumb profile big: the go thumbnailer cannot keep metadata"},
+		{`{"thumbnailer": "vips", "thumb_profiles": {"tiny": {"size": 50, "format": "webp", "keep_metadata": true}}}`, ""},
+		{`{"thumb_profiles": {"tiny": {"size": 50, "format": "avif", "variants": ["webp"]}}}`, ""},
+	}
+	for _, tt := range tests {
+		_, err := load(t, tt.settings)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.settings, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const createSchemaSQL = `
+CREATE TABLE IF NOT EXISTS sets (
+	id integer NOT NULL PRIMARY KEY,
+	thumb_photo_id integer UNIQUE REFERENCES photos,
+	name varchar(4096) NOT NULL UNIQUE,
+	photos_count integer,
+	taken_at char(19),
+	owner_id integer REFERENCES users,
+	public integer NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS sets_thumb_photo_id_index ON sets (thumb_photo_id);
+
+CREATE TABLE IF NOT EXISTS photos (
+	id integer NOT NULL PRIMARY KEY,
+	set_id integer NOT NULL REFERENCES sets,
+	prev_photo_id integer UNIQUE REFERENCES photos,
+	next_photo_id integer UNIQUE REFERENCES photos,
+	path varchar(4096) NOT NULL UNIQUE,
+	size integer NOT NULL,
+	width integer NOT NULL,
+	height integer NOT NULL,
+	aperture decimal(2, 1),
+	camera varchar(1000),
+	exposure_comp integer,
+	exposure_time decimal(9, 5),
+	flash varchar(51),
+	focal_length decimal(3, 1),
+	focal_length_35 integer,
+	iso integer,
+	lat decimal(9, 6),
+	lens varchar(1000),
+	lng decimal(9, 6),
+	taken_at char(19),
+	content_hash char(64),
+	mtime integer,
+	color_space varchar(100),
+	blurhash varchar(100),
+	dominant_color char(7), -- e.g. "#a0b1c2"
+	dhash char(16), -- difference hash, to find near-duplicates
+	hidden integer NOT NULL DEFAULT 0 -- left out of listings, e.g. as a duplicate
+);
+
+CREATE INDEX IF NOT EXISTS photos_set_id_index ON photos (set_id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS photos_prev_photo_id_index ON photos (prev_photo_id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS photos_next_photo_id_index ON photos (next_photo_id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS photos_path_index ON photos (path);
+
+CREATE TABLE IF NOT EXISTS users (
+	id integer NOT NULL PRIMARY KEY,
+	name varchar(255) NOT NULL UNIQUE,
+	password_hash char(60) NOT NULL,
+	admin integer NOT NULL DEFAULT 0,
+	created_at char(19) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id integer NOT NULL PRIMARY KEY,
+	user_id integer NOT NULL REFERENCES users,
+	token_hash char(64) NOT NULL UNIQUE,
+	csrf_token char(64) NOT NULL,
+	expires_at char(19) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_index ON sessions (user_id);
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+	id integer NOT NULL PRIMARY KEY,
+	user_id integer NOT NULL REFERENCES users,
+	name varchar(255),
+	token_hash char(64) NOT NULL UNIQUE,
+	created_at char(19) NOT NULL,
+	last_used_at char(19)
+);
+
+CREATE INDEX IF NOT EXISTS api_tokens_user_id_index ON api_tokens (user_id);
+
+CREATE TABLE IF NOT EXISTS user_groups (
+	id integer NOT NULL PRIMARY KEY,
+	name varchar(255) NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS user_group_members (
+	group_id integer NOT NULL REFERENCES user_groups,
+	user_id integer NOT NULL REFERENCES users,
+	PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS user_group_members_user_id_index ON user_group_members (user_id);
+
+CREATE TABLE IF NOT EXISTS set_grants (
+	id integer NOT NULL PRIMARY KEY,
+	set_id integer NOT NULL REFERENCES sets,
+	user_id integer REFERENCES users,
+	group_id integer REFERENCES user_groups,
+	CHECK ((user_id IS NULL) != (group_id IS NULL))
+);
+
+CREATE INDEX IF NOT EXISTS set_grants_set_id_index ON set_grants (set_id);
+
+CREATE TABLE IF NOT EXISTS shares (
+	id integer NOT NULL PRIMARY KEY,
+	token char(64) NOT NULL UNIQUE,
+	set_id integer REFERENCES sets,
+	photo_id integer REFERENCES photos,
+	created_by integer REFERENCES users,
+	password_hash char(60),
+	allow_download integer NOT NULL DEFAULT 0,
+	expires_at char(19),
+	revoked_at char(19),
+	created_at char(19) NOT NULL,
+	CHECK ((set_id IS NULL) != (photo_id IS NULL))
+);
+
+CREATE TABLE IF NOT EXISTS share_accesses (
+	id integer NOT NULL PRIMARY KEY,
+	share_id integer NOT NULL REFERENCES shares,
+	accessed_at char(19) NOT NULL,
+	remote_addr varchar(255),
+	path varchar(4096)
+);
+
+CREATE INDEX IF NOT EXISTS share_accesses_share_id_index ON share_accesses (share_id);
+
+CREATE TABLE IF NOT EXISTS focal_points (
+	content_hash char(64) NOT NULL PRIMARY KEY, -- of the photos and copies
+	focal_x real NOT NULL, -- the point cropped thumbs keep in view, as
+	focal_y real NOT NULL -- fractions of the width and height
+);
+
+CREATE TABLE IF NOT EXISTS thumbnails (
+	path varchar(4096) NOT NULL PRIMARY KEY,
+	content_hash char(64) NOT NULL, -- of the photos it was rendered from
+	created_at char(19) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS thumbnails_content_hash_index ON thumbnails (content_hash);
+
+CREATE TABLE IF NOT EXISTS thumb_status (
+	photo_path varchar(4096) NOT NULL PRIMARY KEY,
+	content_hash char(64) NOT NULL,
+	status varchar(6) NOT NULL, -- "ok" or "failed"
+	error text,
+	attempts integer NOT NULL DEFAULT 0, -- failed in a row
+	last_attempt_at char(19) NOT NULL
+);
+`
+
+// columns added to tables after they were first created, so that existing
+// databases can be brought up to date
+var addedColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"users", "admin", "integer NOT NULL DEFAULT 0"},
+	{"sets", "owner_id", "integer REFERENCES users"},
+	{"sets", "public", "integer NOT NULL DEFAULT 0"},
+	{"photos", "content_hash", "char(64)"},
+	{"photos", "mtime", "integer"},
+	{"photos", "color_space", "varchar(100)"},
+	{"photos", "blurhash", "varchar(100)"},
+	{"photos", "dominant_color", "char(7)"},
+	{"photos", "dhash", "char(16)"},
+	{"photos", "hidden", "integer NOT NULL DEFAULT 0"},
+}
+
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
+
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(createSchemaSQL); err != nil {
+		return err
+	}
+
+	for _, c := range addedColumns {
+		exists, err := hasColumn(db, c.table, c.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition))
+		if err != nil {
+			return err
+		}
+	}
+
+	// indexes on added columns
+	_, err := db.Exec(`
+	CREATE INDEX IF NOT EXISTS photos_content_hash_index ON photos (content_hash);
+	`)
+	return err
+}
+
+// Open opens the database at dbPath, creating or updating its schema
+func Open(dbPath string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// CopyFocus gives the new contents of an edited photo the focal point of its
+// old contents, unless they have one already
+func CopyFocus(db *sql.DB, newHash, oldHash string) error {
+	_, err := db.Exec(`
+	INSERT OR IGNORE INTO focal_points (content_hash, focal_x, focal_y)
+	SELECT ?, focal_x, focal_y FROM focal_points WHERE content_hash = ?
+	`, newHash, oldHash)
+	return err
+}
@@ -0,0 +1,179 @@
+package icc
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// ErrUnsupportedProfile is returned for profiles other than RGB matrix/TRC
+// ones, e.g. those made of lookup tables
+var ErrUnsupportedProfile = errors.New("unsupported ICC profile")
+
+// from linear light XYZ, adapted to the D50 white point of ICC profiles, to
+// linear sRGB
+var xyzToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// steps of linear light that sRGB values are looked up for, enough to tell
+// apart the darkest 8-bit values
+const encodeSteps = 8192
+
+// Transform converts colors from an RGB matrix/TRC profile, such as Adobe RGB
+// or Display P3, to sRGB
+type Transform struct {
+	toLinear [3][256]float64 // tone curve of each channel
+	matrix   [3][3]float64   // from linear profile RGB to linear sRGB
+	encode   [encodeSteps + 1]uint8
+}
+
+// NewTransform returns a Transform from the colors of profile to sRGB
+func NewTransform(profile []byte) (*Transform, error) {
+	if len(profile) < 132 || string(profile[16:20]) != "RGB " || string(profile[20:24]) != "XYZ " {
+		return nil, ErrUnsupportedProfile
+	}
+
+	t := &Transform{}
+
+	var primaries [3][3]float64 // columns are the XYZ of red, green and blue
+	for c, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, ok := decodeXYZ(findTag(profile, sig))
+		if !ok {
+			return nil, ErrUnsupportedProfile
+		}
+		for i := range xyz {
+			primaries[i][c] = xyz[i]
+		}
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				t.matrix[i][j] += xyzToSRGB[i][k] * primaries[k][j]
+			}
+		}
+	}
+
+	for c, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, ok := decodeCurve(findTag(profile, sig))
+		if !ok {
+			return nil, ErrUnsupportedProfile
+		}
+		for v := range t.toLinear[c] {
+			t.toLinear[c][v] = curve(float64(v) / 255)
+		}
+	}
+
+	for i := range t.encode {
+		v := float64(i) / encodeSteps
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		t.encode[i] = uint8(math.Round(255 * v))
+	}
+
+	return t, nil
+}
+
+// Apply converts the colors of RGBA pixels in place, leaving alpha alone
+func (t *Transform) Apply(pix []uint8) {
+	for i := 0; i+3 < len(pix); i += 4 {
+		r := t.toLinear[0][pix[i]]
+		g := t.toLinear[1][pix[i+1]]
+		b := t.toLinear[2][pix[i+2]]
+		for c := 0; c < 3; c++ {
+			v := t.matrix[c][0]*r + t.matrix[c][1]*g + t.matrix[c][2]*b
+			if !(v > 0) { // including NaN from odd curves
+				v = 0
+			}
+			pix[i+c] = t.encode[int(math.Round(encodeSteps*math.Min(1, v)))]
+		}
+	}
+}
+
+// s15Fixed16 decodes a signed fixed point number with 16 fractional bits
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// decodeXYZ decodes an XYZType tag
+func decodeXYZ(tag []byte) ([3]float64, bool) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return [3]float64{}, false
+	}
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, true
+}
+
+// decodeCurve decodes a curveType or parametricCurveType tag into a function
+// from encoded values to linear light, both from 0 to 1
+func decodeCurve(tag []byte) (func(float64) float64, bool) {
+	if len(tag) < 12 {
+		return nil, false
+	}
+
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case n == 0:
+			return func(x float64) float64 { return x }, true
+		case n == 1 && len(tag) >= 14:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, true
+		case n > 1 && len(tag) >= 12+2*n:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+			}
+			return func(x float64) float64 { // interpolated linearly
+				pos := x * float64(n-1)
+				i := min(int(pos), n-2)
+				return table[i] + (pos-float64(i))*(table[i+1]-table[i])
+			}, true
+		}
+	case "para":
+		paramCounts := []int{1, 3, 4, 5, 7}
+		kind := int(binary.BigEndian.Uint16(tag[8:]))
+		if kind >= len(paramCounts) || len(tag) < 12+4*paramCounts[kind] {
+			return nil, false
+		}
+		var p [7]float64 // g, a, b, c, d, e, f
+		for i := 0; i < paramCounts[kind]; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+
+		return func(x float64) float64 {
+			switch kind {
+			case 0:
+				return math.Pow(x, g)
+			case 1:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			case 2:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			case 3:
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			default:
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + f
+			}
+		}, true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,192 @@
+package icc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	markerPrefix = 0xff
+	markerSOI    = 0xd8
+	markerAPP2   = 0xe2
+	markerSOS    = 0xda
+
+	maxChunkSize = 65519 // segment length limit minus the length, header and sequence numbers
+)
+
+// ICC profiles are split into APP2 segments starting with this header,
+// followed by a sequence number and the number of segments
+var chunkHeader = []byte("ICC_PROFILE\x00")
+
+var ErrNotJPEG = errors.New("not a JPEG file")
+
+// FromJPEG returns the ICC profile embedded in a JPEG file, or nil if there
+// is none
+func FromJPEG(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi[0] != markerPrefix || soi[1] != markerSOI {
+		return nil, ErrNotJPEG
+	}
+
+	chunks := map[byte][]byte{}
+	var count byte
+
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(br, marker[:]); err != nil {
+			return nil, err
+		}
+		if marker[0] != markerPrefix {
+			return nil, ErrNotJPEG
+		}
+		if marker[1] == markerPrefix { // fill byte
+			br.UnreadByte()
+			continue
+		}
+		if marker[1] == markerSOS { // image data follows, no more metadata
+			break
+		}
+
+		var length uint16
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		if length < 2 {
+			return nil, ErrNotJPEG
+		}
+
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return nil, err
+		}
+
+		if marker[1] == markerAPP2 && len(segment) > len(chunkHeader)+2 &&
+			bytes.Equal(segment[:len(chunkHeader)], chunkHeader) {
+			seq := segment[len(chunkHeader)]
+			count = segment[len(chunkHeader)+1]
+			chunks[seq] = segment[len(chunkHeader)+2:]
+		}
+	}
+
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+
+	var profile []byte
+	for seq := byte(1); seq <= count; seq++ {
+		chunk, ok := chunks[seq]
+		if !ok {
+			return nil, errors.New("incomplete ICC profile")
+		}
+		profile = append(profile, chunk...)
+	}
+	return profile, nil
+}
+
+// EmbedJPEG writes the JPEG data in jpg to w with an ICC profile embedded
+// right after the start of image marker
+func EmbedJPEG(w io.Writer, jpg, profile []byte) error {
+	if len(jpg) < 2 || jpg[0] != markerPrefix || jpg[1] != markerSOI {
+		return ErrNotJPEG
+	}
+	if _, err := w.Write(jpg[:2]); err != nil {
+		return err
+	}
+
+	count := (len(profile) + maxChunkSize - 1) / maxChunkSize
+	if count > 255 {
+		return errors.New("ICC profile too large")
+	}
+
+	for i := 0; i < count; i++ {
+		chunk := profile[i*maxChunkSize : min((i+1)*maxChunkSize, len(profile))]
+
+		var segment bytes.Buffer
+		segment.Write([]byte{markerPrefix, markerAPP2})
+		binary.Write(&segment, binary.BigEndian, uint16(2+len(chunkHeader)+2+len(chunk)))
+		segment.Write(chunkHeader)
+		segment.Write([]byte{byte(i + 1), byte(count)})
+		segment.Write(chunk)
+
+		if _, err := w.Write(segment.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(jpg[2:])
+	return err
+}
+
+// Description returns the name of a profile, e.g. "Display P3", or "" if it
+// has none
+func Description(profile []byte) string {
+	tag := findTag(profile, "desc")
+	if len(tag) < 12 {
+		return ""
+	}
+	return decodeText(tag)
+}
+
+// findTag returns the data of the tag with the given signature, or nil if the
+// profile has none
+func findTag(profile []byte, sig string) []byte {
+	if len(profile) < 132 {
+		return nil
+	}
+
+	tagCount := binary.BigEndian.Uint32(profile[128:])
+	for i := uint32(0); i < tagCount; i++ {
+		entry := 132 + int(i)*12
+		if entry+12 > len(profile) {
+			return nil
+		}
+		if string(profile[entry:entry+4]) != sig {
+			continue
+		}
+
+		offset := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil
+		}
+		return profile[offset : offset+size]
+	}
+
+	return nil
+}
+
+// decodeText decodes a textDescriptionType (ICC v2) or
+// multiLocalizedUnicodeType (ICC v4) tag, taking the first localization
+func decodeText(tag []byte) string {
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n > len(tag)-12 {
+			return ""
+		}
+		return strings.TrimRight(string(tag[12:12+n]), "\x00")
+	case "mluc":
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:]) == 0 {
+			return ""
+		}
+		n := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if offset+n > len(tag) {
+			return ""
+		}
+
+		units := make([]uint16, n/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[offset+2*i:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+	return ""
+}
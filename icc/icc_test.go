@@ -0,0 +1,170 @@
+package icc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+// D50 adapted primaries of sRGB and Adobe RGB
+var (
+	srgbPrimaries  = [3][3]float64{{0.4360747, 0.2225045, 0.0139322}, {0.3850649, 0.7168786, 0.0971045}, {0.1430804, 0.0606169, 0.7141733}}
+	adobePrimaries = [3][3]float64{{0.6097559, 0.3111242, 0.0194811}, {0.2052401, 0.6256560, 0.0608902}, {0.1492240, 0.0632197, 0.7448387}}
+)
+
+func fixed(v float64) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(int32(math.Round(v*65536))))
+}
+
+func gammaCurve(gamma float64) []byte {
+	tag := append([]byte("curv\x00\x00\x00\x00"), 0, 0, 0, 1)
+	return binary.BigEndian.AppendUint16(tag, uint16(gamma*256))
+}
+
+func paraCurve(kind uint16, params ...float64) []byte {
+	tag := binary.BigEndian.AppendUint16([]byte("para\x00\x00\x00\x00"), kind)
+	tag = append(tag, 0, 0)
+	for _, p := range params {
+		tag = append(tag, fixed(p)...)
+	}
+	return tag
+}
+
+func descText(text string) []byte {
+	tag := binary.BigEndian.AppendUint32([]byte("desc\x00\x00\x00\x00"), uint32(len(text)+1))
+	return append(append(tag, text...), 0)
+}
+
+// makeProfile builds an RGB matrix/TRC profile with the same curve for every
+// channel
+func makeProfile(desc string, primaries [3][3]float64, curve []byte) []byte {
+	type tag struct {
+		sig  string
+		data []byte
+	}
+	tags := []tag{{"desc", descText(desc)}}
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		data := []byte("XYZ \x00\x00\x00\x00")
+		for _, v := range primaries[i] {
+			data = append(data, fixed(v)...)
+		}
+		tags = append(tags, tag{sig, data})
+	}
+	for _, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		tags = append(tags, tag{sig, curve})
+	}
+
+	header := make([]byte, 128)
+	copy(header[16:], "RGB XYZ ")
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	var data []byte
+	offset := 128 + 4 + 12*len(tags)
+	for _, t := range tags {
+		table = append(table, t.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offset+len(data)))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(t.data)))
+		data = append(data, t.data...)
+	}
+	return append(append(header, table...), data...)
+}
+
+func TestEmbedJPEG(t *testing.T) {
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		profile []byte
+	}{
+		{"small", makeProfile("Adobe RGB (1998)", adobePrimaries, gammaCurve(2.2))},
+		{"split", bytes.Repeat([]byte{7}, 2*maxChunkSize+10)},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := EmbedJPEG(&buf, jpg.Bytes(), tt.profile); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		profile, err := FromJPEG(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(profile, tt.profile) {
+			t.Errorf("%s: got %d bytes back, want %d", tt.name, len(profile), len(tt.profile))
+		}
+		if _, err := jpeg.Decode(&buf); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	if profile, err := FromJPEG(bytes.NewReader(jpg.Bytes())); profile != nil || err != nil {
+		t.Errorf("no profile: got %v, %v", profile, err)
+	}
+	if _, err := FromJPEG(bytes.NewReader([]byte("GIF89a"))); err != ErrNotJPEG {
+		t.Errorf("not a JPEG: got %v", err)
+	}
+}
+
+func TestDescription(t *testing.T) {
+	tests := []struct {
+		profile []byte
+		want    string
+	}{
+		{makeProfile("Display P3", srgbPrimaries, gammaCurve(2.2)), "Display P3"},
+		{nil, ""},
+		{make([]byte, 132), ""},
+	}
+	for _, tt := range tests {
+		if got := Description(tt.profile); got != tt.want {
+			t.Errorf("Description() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	srgbCurve := paraCurve(3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045)
+
+	tests := []struct {
+		name    string
+		profile []byte
+		in      [3]uint8
+		want    [3]uint8
+	}{
+		{"srgb", makeProfile("sRGB", srgbPrimaries, srgbCurve), [3]uint8{200, 100, 30}, [3]uint8{200, 100, 30}},
+		{"srgb black", makeProfile("sRGB", srgbPrimaries, srgbCurve), [3]uint8{0, 0, 0}, [3]uint8{0, 0, 0}},
+		{"linear", makeProfile("linear", srgbPrimaries, paraCurve(0, 1)), [3]uint8{128, 128, 128}, [3]uint8{188, 188, 188}},
+		{"adobe white", makeProfile("Adobe RGB", adobePrimaries, gammaCurve(2.2)), [3]uint8{255, 255, 255}, [3]uint8{255, 255, 255}},
+		{"adobe grey", makeProfile("Adobe RGB", adobePrimaries, gammaCurve(2.2)), [3]uint8{128, 128, 128}, [3]uint8{129, 129, 129}},
+		{"adobe green", makeProfile("Adobe RGB", adobePrimaries, gammaCurve(2.2)), [3]uint8{0, 255, 0}, [3]uint8{0, 255, 0}},
+	}
+	for _, tt := range tests {
+		tr, err := NewTransform(tt.profile)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		pix := []uint8{tt.in[0], tt.in[1], tt.in[2], 255}
+		tr.Apply(pix)
+		for c := 0; c < 3; c++ {
+			if d := int(pix[c]) - int(tt.want[c]); d < -1 || d > 1 {
+				t.Errorf("%s: got %v, want %v", tt.name, pix[:3], tt.want)
+				break
+			}
+		}
+		if pix[3] != 255 {
+			t.Errorf("%s: alpha changed to %d", tt.name, pix[3])
+		}
+	}
+
+	lut := makeProfile("lut", srgbPrimaries, srgbCurve)
+	copy(lut[20:], "Lab ")
+	if _, err := NewTransform(lut); err != ErrUnsupportedProfile {
+		t.Errorf("Lab PCS: got %v", err)
+	}
+	if _, err := NewTransform(makeProfile("no curve", srgbPrimaries, []byte("mft2\x00\x00\x00\x00"))); err != ErrUnsupportedProfile {
+		t.Errorf("lookup table curve: got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package photos
+
+import (
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+)
+
+// dHash returns the difference hash of the image in path: its luminance
+// averaged over 9x8 cells, with a bit for each pair of neighbouring cells in
+// a row that is set if the left one is brighter. Copies that were resized or
+// recompressed get the same or a close hash.
+func dHash(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, err
+	}
+
+	// average the luminance over each cell of a 9x8 grid, reading the luma
+	// plane of JPEG images directly
+	var sums, counts [8][9]float64
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	ycbcr, isYCbCr := img.(*image.YCbCr)
+
+	for y := 0; y < h; y++ {
+		row := y * 8 / h
+		for x := 0; x < w; x++ {
+			col := x * 9 / w
+
+			var luma uint8
+			if isYCbCr {
+				luma = ycbcr.Y[ycbcr.YOffset(bounds.Min.X+x, bounds.Min.Y+y)]
+			} else {
+				luma = color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y
+			}
+			sums[row][col] += float64(luma)
+			counts[row][col]++
+		}
+	}
+
+	var small [8][9]float64
+	for row := range small {
+		for col := range small[row] {
+			small[row][col] = sums[row][col] / max(1, counts[row][col])
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small[y][x] > small[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// dHashFile returns the difference hash of a photo as stored, or null if it
+// cannot be decoded
+func dHashFile(path string) sql.NullString {
+	hash, err := dHash(path)
+	if err != nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: fmt.Sprintf("%016x", hash), Valid: true}
+}
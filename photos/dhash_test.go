@@ -0,0 +1,86 @@
+package photos
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeImage writes a w x h image whose brightness at x, y is given by f, as
+// JPEG or PNG depending on the extension of name
+func writeImage(t *testing.T, name string, w, h int, f func(x, y int) uint8) string {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetGray(x, y, color.Gray{f(x, y)})
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), name)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if filepath.Ext(name) == ".png" {
+		err = png.Encode(file, img)
+	} else {
+		err = jpeg.Encode(file, img, &jpeg.Options{Quality: 80})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDHash(t *testing.T) {
+	darker := func(x, y int) uint8 { return uint8(255 - x) }
+	brighter := func(x, y int) uint8 { return uint8(x) }
+	blocks := func(x, y int) uint8 { return uint8((x/32 + y/32) % 2 * 200) }
+
+	tests := []struct {
+		name string
+		path string
+		want uint64
+	}{
+		{"darker to the right", writeImage(t, "a.png", 180, 80, darker), 0xffffffffffffffff},
+		{"brighter to the right", writeImage(t, "b.png", 180, 80, brighter), 0},
+		{"flat", writeImage(t, "c.png", 90, 80, func(x, y int) uint8 { return 100 }), 0},
+		{"jpeg", writeImage(t, "d.jpg", 180, 80, darker), 0xffffffffffffffff},
+	}
+	for _, tt := range tests {
+		got, err := dHash(tt.path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: dHash() = %016x, want %016x", tt.name, got, tt.want)
+		}
+	}
+
+	// resized and recompressed copies get close hashes
+	large, err := dHash(writeImage(t, "large.png", 512, 384, blocks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := dHash(writeImage(t, "small.jpg", 128, 96, func(x, y int) uint8 { return blocks(4*x, 4*y) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := bits.OnesCount64(large ^ small); d > DefaultDuplicateThreshold {
+		t.Errorf("resized copy differs in %d bits", d)
+	}
+
+	if hash := dHashFile(filepath.Join(t.TempDir(), "missing.jpg")); hash.Valid {
+		t.Errorf("missing file: got %q", hash.String)
+	}
+	if hash := dHashFile(writeImage(t, "e.png", 180, 80, darker)); hash.String != "ffffffffffffffff" {
+		t.Errorf("dHashFile() = %q", hash.String)
+	}
+}
@@ -0,0 +1,245 @@
+package photos
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// DefaultDuplicateThreshold is the number of bits the difference hashes of
+// near-duplicates may differ in by default
+const DefaultDuplicateThreshold = 10
+
+// DuplicatesOptions change what Duplicates does about the groups it finds
+type DuplicatesOptions struct {
+	Threshold int  // bits the difference hashes of near-duplicates may differ in
+	KeepBest  bool // hide all photos of each group but the best
+	Unhide    bool // show all hidden photos again instead
+	JSON      bool // list groups as JSON
+}
+
+// DuplicatePhoto is a photo in a group of duplicates
+type DuplicatePhoto struct {
+	Id     int    `json:"id"`
+	SetId  int    `json:"set_id"`
+	Path   string `json:"path"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Size   int64  `json:"size"`
+
+	contentHash string
+	dHash       uint64
+	hasDHash    bool
+}
+
+// DuplicateGroup lists copies of a photo, best (largest) first
+type DuplicateGroup struct {
+	Kind   string            `json:"kind"` // "exact" or "similar"
+	Photos []*DuplicatePhoto `json:"photos"`
+}
+
+// better reports whether a photo is worth keeping over b: it has more
+// pixels, or is larger, or was scanned first
+func (p *DuplicatePhoto) better(b *DuplicatePhoto) bool {
+	if pa, pb := p.Width*p.Height, b.Width*b.Height; pa != pb {
+		return pa > pb
+	}
+	if p.Size != b.Size {
+		return p.Size > b.Size
+	}
+	return p.Id < b.Id
+}
+
+// FindDuplicates groups the visible photos in the database that have the
+// same contents (exact) or difference hashes at most threshold bits apart
+// (similar). Photos scanned before difference hashes were kept only match
+// exact copies until the next scan.
+func FindDuplicates(db *sql.DB, threshold int) ([]DuplicateGroup, error) {
+	contents, err := DuplicateCandidates(db)
+	if err != nil {
+		return nil, err
+	}
+	return GroupDuplicates(contents, threshold), nil
+}
+
+// DuplicateCandidates reads the visible photos in the database, grouped by
+// contents, for GroupDuplicates
+func DuplicateCandidates(db *sql.DB) ([][]*DuplicatePhoto, error) {
+	rows, err := db.Query(`
+	SELECT id, set_id, path, width, height, size, content_hash, dhash
+	FROM photos WHERE hidden = 0 AND content_hash IS NOT NULL ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// copies share a content hash, so near-duplicates are looked for among
+	// the distinct contents only
+	var contents [][]*DuplicatePhoto
+	byHash := map[string]int{}
+
+	for rows.Next() {
+		p := &DuplicatePhoto{}
+		var dHash sql.NullString
+		err := rows.Scan(&p.Id, &p.SetId, &p.Path, &p.Width, &p.Height, &p.Size, &p.contentHash, &dHash)
+		if err != nil {
+			return nil, err
+		}
+		if dHash.Valid {
+			p.dHash, err = strconv.ParseUint(dHash.String, 16, 64)
+			p.hasDHash = err == nil
+		}
+
+		i, ok := byHash[p.contentHash]
+		if !ok {
+			i = len(contents)
+			byHash[p.contentHash] = i
+			contents = append(contents, nil)
+		}
+		contents[i] = append(contents[i], p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return contents, nil
+}
+
+// GroupDuplicates groups photos read by DuplicateCandidates. It compares the
+// best photos of all contents with each other, so it is best called without
+// holding the database.
+func GroupDuplicates(contents [][]*DuplicatePhoto, threshold int) []DuplicateGroup {
+	// each group is formed around its best photo, which -keep-best keeps, and
+	// takes the contents close enough to it. Grouping neighbours of
+	// neighbours instead would chain distinct photos together.
+	for _, copies := range contents {
+		sort.SliceStable(copies, func(i, j int) bool { return copies[i].better(copies[j]) })
+	}
+	sort.SliceStable(contents, func(i, j int) bool { return contents[i][0].better(contents[j][0]) })
+
+	grouped := make([]bool, len(contents))
+	var groups []DuplicateGroup
+	for i := range contents {
+		if grouped[i] {
+			continue
+		}
+		grouped[i] = true
+
+		group := DuplicateGroup{Kind: "exact", Photos: contents[i]}
+		if best := contents[i][0]; best.hasDHash {
+			for j := i + 1; j < len(contents); j++ {
+				p := contents[j][0]
+				if !grouped[j] && p.hasDHash && bits.OnesCount64(best.dHash^p.dHash) <= threshold {
+					grouped[j] = true
+					group.Kind = "similar"
+					group.Photos = append(group.Photos, contents[j]...)
+				}
+			}
+		}
+		if len(group.Photos) < 2 {
+			continue
+		}
+
+		sort.SliceStable(group.Photos, func(i, j int) bool {
+			return group.Photos[i].better(group.Photos[j])
+		})
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+// hideDuplicates hides all photos of each group but the first (best)
+func hideDuplicates(groups []DuplicateGroup) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, group := range groups {
+		for _, p := range group.Photos[1:] {
+			if _, err := tx.Exec("UPDATE photos SET hidden = 1 WHERE id = ?", p.Id); err != nil {
+				return err
+			}
+			printf("photos id=%d hidden=1\n", p.Id)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func unhidePhotos() error {
+	result, err := db.Exec("UPDATE photos SET hidden = 0 WHERE hidden = 1")
+	if err != nil {
+		return err
+	}
+	n, _ := result.RowsAffected()
+	printf("photos hidden=0 count=%d\n", n)
+	return nil
+}
+
+// Duplicates lists groups of duplicate photos and, with KeepBest, hides all
+// but the best of each from listings, updating set covers, counts and
+// neighbours to match
+func Duplicates(opts DuplicatesOptions) {
+	quiet = opts.JSON
+
+	setupDatabase()
+	defer db.Close()
+	defer selectSetStmt.Close()
+	defer selectPhotoStmt.Close()
+	defer insertSetStmt.Close()
+	defer insertPhotoStmt.Close()
+	defer updateHashStmt.Close()
+	defer updateColorStmt.Close()
+	defer updateDHashStmt.Close()
+
+	if opts.Unhide {
+		if err := unhidePhotos(); err != nil {
+			log.Fatal(err)
+		}
+		updatePhotoSiblings()
+		updateSets()
+		return
+	}
+
+	groups, err := FindDuplicates(db, opts.Threshold)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if opts.JSON {
+		if groups == nil {
+			groups = []DuplicateGroup{}
+		}
+		json.NewEncoder(os.Stdout).Encode(groups)
+	} else {
+		for _, group := range groups {
+			fmt.Printf("%s (%d photos):\n", group.Kind, len(group.Photos))
+			for i, p := range group.Photos {
+				mark := " "
+				if i == 0 {
+					mark = "*" // best
+				}
+				fmt.Printf("  %s %s (%dx%d, %d bytes)\n", mark, p.Path, p.Width, p.Height, p.Size)
+			}
+		}
+	}
+
+	if !opts.KeepBest || len(groups) == 0 {
+		return
+	}
+
+	if err := hideDuplicates(groups); err != nil {
+		log.Fatal(err)
+	}
+	updatePhotoSiblings()
+	updateSets()
+}
@@ -0,0 +1,90 @@
+package photos
+
+import (
+	"reflect"
+	"testing"
+)
+
+func photo(id, width, height int, size int64, dHash uint64, hasDHash bool) *DuplicatePhoto {
+	return &DuplicatePhoto{Id: id, Width: width, Height: height, Size: size, dHash: dHash, hasDHash: hasDHash}
+}
+
+func ids(groups []DuplicateGroup) [][]int {
+	var result [][]int
+	for _, group := range groups {
+		var groupIds []int
+		for _, p := range group.Photos {
+			groupIds = append(groupIds, p.Id)
+		}
+		result = append(result, groupIds)
+	}
+	return result
+}
+
+func TestGroupDuplicates(t *testing.T) {
+	tests := []struct {
+		name      string
+		contents  [][]*DuplicatePhoto
+		threshold int
+		want      [][]int
+		kinds     []string
+	}{
+		{
+			"exact copies, best first",
+			[][]*DuplicatePhoto{{photo(1, 100, 100, 10, 0, true), photo(2, 200, 100, 10, 0, true), photo(3, 200, 100, 20, 0, true)}},
+			0, [][]int{{3, 2, 1}}, []string{"exact"},
+		},
+		{
+			"single photos",
+			[][]*DuplicatePhoto{{photo(1, 100, 100, 10, 0x0f, true)}, {photo(2, 100, 100, 10, 0xf0, true)}},
+			4, nil, nil,
+		},
+		{
+			"similar within threshold",
+			[][]*DuplicatePhoto{{photo(1, 100, 100, 10, 0x00, true)}, {photo(2, 400, 300, 10, 0x07, true)}},
+			3, [][]int{{2, 1}}, []string{"similar"},
+		},
+		{
+			"similar beyond threshold",
+			[][]*DuplicatePhoto{{photo(1, 100, 100, 10, 0x00, true)}, {photo(2, 400, 300, 10, 0x0f, true)}},
+			3, nil, nil,
+		},
+		{
+			"no difference hash",
+			[][]*DuplicatePhoto{{photo(1, 100, 100, 10, 0, false)}, {photo(2, 100, 100, 10, 0, true)}},
+			10, nil, nil,
+		},
+		{
+			// 3 is within reach of the best photo but 4 only of 3, so
+			// neighbours of neighbours do not chain
+			"no chaining",
+			[][]*DuplicatePhoto{
+				{photo(1, 400, 400, 10, 0x00, true)},
+				{photo(3, 300, 300, 10, 0x03, true)},
+				{photo(4, 200, 200, 10, 0x0f, true)},
+				{photo(5, 100, 100, 10, 0x0e, true)},
+			},
+			2, [][]int{{1, 3}, {4, 5}}, []string{"similar", "similar"},
+		},
+		{
+			"copies join similar groups",
+			[][]*DuplicatePhoto{
+				{photo(1, 100, 100, 10, 0x01, true), photo(2, 100, 100, 10, 0x01, true)},
+				{photo(3, 200, 200, 10, 0x00, true)},
+			},
+			1, [][]int{{3, 1, 2}}, []string{"similar"},
+		},
+	}
+	for _, tt := range tests {
+		groups := GroupDuplicates(tt.contents, tt.threshold)
+		if got := ids(groups); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i, group := range groups {
+			if group.Kind != tt.kinds[i] {
+				t.Errorf("%s: group %d is %s, want %s", tt.name, i, group.Kind, tt.kinds[i])
+			}
+		}
+	}
+}
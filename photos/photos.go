@@ -8,64 +8,42 @@ import (
 	"log"
 	"mime"
 	"os"
-	"path"
 	"path/filepath"
 
 	"github.com/agorf/goexif/exif"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/agorf/thyme-backend/config"
+	"github.com/agorf/thyme-backend/database"
+	"github.com/agorf/thyme-backend/icc"
+	"github.com/agorf/thyme-backend/progress"
+	"github.com/agorf/thyme-backend/thumb"
 )
 
-const createSchemaSQL = `
-CREATE TABLE IF NOT EXISTS sets (
-	id integer NOT NULL PRIMARY KEY,
-	thumb_photo_id integer UNIQUE REFERENCES photos,
-	name varchar(4096) NOT NULL UNIQUE,
-	photos_count integer,
-	taken_at char(19)
-);
-
-CREATE UNIQUE INDEX IF NOT EXISTS sets_thumb_photo_id_index ON sets (thumb_photo_id);
-
-CREATE TABLE IF NOT EXISTS photos (
-	id integer NOT NULL PRIMARY KEY,
-	set_id integer NOT NULL REFERENCES sets,
-	prev_photo_id integer UNIQUE REFERENCES photos,
-	next_photo_id integer UNIQUE REFERENCES photos,
-	path varchar(4096) NOT NULL UNIQUE,
-	size integer NOT NULL,
-	width integer NOT NULL,
-	height integer NOT NULL,
-	aperture decimal(2, 1),
-	camera varchar(1000),
-	exposure_comp integer,
-	exposure_time decimal(9, 5),
-	flash varchar(51),
-	focal_length decimal(3, 1),
-	focal_length_35 integer,
-	iso integer,
-	lat decimal(9, 6),
-	lens varchar(1000),
-	lng decimal(9, 6),
-	taken_at char(19)
-);
-
-CREATE INDEX IF NOT EXISTS photos_set_id_index ON photos (set_id);
-
-CREATE UNIQUE INDEX IF NOT EXISTS photos_prev_photo_id_index ON photos (prev_photo_id);
-
-CREATE UNIQUE INDEX IF NOT EXISTS photos_next_photo_id_index ON photos (next_photo_id);
-
-CREATE UNIQUE INDEX IF NOT EXISTS photos_path_index ON photos (path);
-`
-
 var (
 	db              *sql.DB
 	selectSetStmt   *sql.Stmt
 	selectPhotoStmt *sql.Stmt
 	insertSetStmt   *sql.Stmt
 	insertPhotoStmt *sql.Stmt
+	updateHashStmt  *sql.Stmt
+	updateColorStmt *sql.Stmt
+	updateDHashStmt *sql.Stmt
+
+	reporter progress.Reporter
+	quiet    bool // whether changes are reported as JSON events instead
 )
 
+// ScanOptions change how Scan reports what it does
+type ScanOptions struct {
+	JSON bool // report progress as JSON events instead of listing changes
+}
+
+// printf lists a change to the database
+func printf(format string, a ...interface{}) {
+	if !quiet {
+		fmt.Printf(format, a...)
+	}
+}
+
 type Photo struct {
 	Aperture      sql.NullFloat64
 	Camera        sql.NullString
@@ -83,6 +61,10 @@ type Photo struct {
 	Size          int64
 	TakenAt       sql.NullString
 	Width         int
+	ContentHash   string
+	ModTime       int64          // Unix nanoseconds
+	ColorSpace    sql.NullString // e.g. "sRGB" or "Display P3"
+	DHash         sql.NullString // difference hash, in hex
 }
 
 func (p *Photo) decodeExif(x *exif.Exif) {
@@ -177,6 +159,22 @@ func (p *Photo) decodeExif(x *exif.Exif) {
 		p.ISO.Valid = true
 	}
 
+	// an embedded ICC profile takes precedence
+	colorSpaceTag, err := x.Get(exif.ColorSpace)
+	if err == nil && !p.ColorSpace.Valid {
+		switch colorSpace, _ := colorSpaceTag.Int(0); colorSpace {
+		case 1:
+			p.ColorSpace.String, p.ColorSpace.Valid = "sRGB", true
+		case 0xffff: // uncalibrated, which cameras use for Adobe RGB
+			p.ColorSpace.String, p.ColorSpace.Valid = "Uncalibrated", true
+			if interopTag, err := x.Get(exif.InteroperabilityIndex); err == nil {
+				if interop, _ := interopTag.StringVal(); interop == "R03" {
+					p.ColorSpace.String = "Adobe RGB"
+				}
+			}
+		}
+	}
+
 	expBiasTag, err := x.Get(exif.ExposureBiasValue)
 	if err == nil {
 		p.ExposureComp.Int64, _ = expBiasTag.Int64(0)
@@ -204,6 +202,7 @@ func (p *Photo) decode(path string) error {
 		return err
 	}
 	p.Size = fi.Size()
+	p.ModTime = fi.ModTime().UnixNano()
 
 	img, _, err := image.DecodeConfig(f)
 	if err != nil {
@@ -213,6 +212,13 @@ func (p *Photo) decode(path string) error {
 
 	f.Seek(0, 0) // rewind
 
+	if profile, err := icc.FromJPEG(f); err == nil && profile != nil {
+		p.ColorSpace.String = icc.Description(profile)
+		p.ColorSpace.Valid = p.ColorSpace.String != ""
+	}
+
+	f.Seek(0, 0) // rewind
+
 	x, err := exif.Decode(f)
 	if err == nil { // EXIF data exists
 		p.decodeExif(x)
@@ -238,12 +244,22 @@ func (p *Photo) store() error {
 		}
 	}
 
+	var size, modTime sql.NullInt64
+	var contentHash, colorSpace, dHash sql.NullString
+
 	row = selectPhotoStmt.QueryRow(p.Path)
-	if err := row.Scan(&photoId); err == sql.ErrNoRows { // photo does not exist
+	err := row.Scan(&photoId, &size, &modTime, &contentHash, &colorSpace, &dHash)
+	if err == sql.ErrNoRows { // photo does not exist
+		if p.ContentHash, err = thumb.HashFile(p.Path); err != nil {
+			return err
+		}
+		p.DHash = dHashFile(p.Path)
+
 		result, err := insertPhotoStmt.Exec(p.Aperture, p.Camera,
 			p.ExposureComp, p.ExposureTime, p.Flash, p.FocalLength,
 			p.FocalLength35, p.Height, p.ISO, p.Lat, p.Lens,
-			p.Lng, p.Path, setId, p.Size, p.TakenAt, p.Width) // create it
+			p.Lng, p.Path, setId, p.Size, p.TakenAt, p.Width,
+			p.ContentHash, p.ModTime, p.ColorSpace, p.DHash) // create it
 		if err != nil {
 			return err
 		}
@@ -253,7 +269,51 @@ func (p *Photo) store() error {
 			return err
 		}
 
-		fmt.Printf("photos id=%d path=%s\n", photoId, p.Path)
+		printf("photos id=%d path=%s\n", photoId, p.Path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if colorSpace != p.ColorSpace {
+		if _, err := updateColorStmt.Exec(p.ColorSpace, photoId); err != nil {
+			return err
+		}
+		printf("photos id=%d color_space=%q\n", photoId, p.ColorSpace.String)
+	}
+
+	// hash photos scanned before hashes were kept and photos that changed
+	changed := !contentHash.Valid || size.Int64 != p.Size || modTime.Int64 != p.ModTime
+
+	if changed || !dHash.Valid {
+		p.DHash = dHashFile(p.Path)
+		if p.DHash != dHash {
+			if _, err := updateDHashStmt.Exec(p.DHash, photoId); err != nil {
+				return err
+			}
+			printf("photos id=%d dhash=%s\n", photoId, p.DHash.String)
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if p.ContentHash, err = thumb.HashFile(p.Path); err != nil {
+		return err
+	}
+
+	if _, err := updateHashStmt.Exec(p.ContentHash, p.Size, p.ModTime, photoId); err != nil {
+		return err
+	}
+
+	if p.ContentHash != contentHash.String {
+		printf("photos id=%d content_hash=%s\n", photoId, p.ContentHash)
+
+		if err := database.CopyFocus(db, p.ContentHash, contentHash.String); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -281,10 +341,16 @@ func walkPath(path string, info os.FileInfo, err error) error {
 	}
 
 	photo := &Photo{}
-	if err := photo.decode(path); err == nil {
-		photo.store()
+	if err := photo.decode(path); err != nil {
+		reporter.Failed(path, err)
+		return nil // next
+	}
+	if err := photo.store(); err != nil {
+		reporter.Failed(path, err)
+		return nil // next
 	}
 
+	reporter.Processed(path)
 	return nil // next
 }
 
@@ -312,8 +378,17 @@ func updatePhotoSiblings() error {
 	}
 	defer updateNextPhotoStmt.Close()
 
+	// start over, since hidden photos drop out of the sequence and the
+	// pointers are unique
+	_, err = tx.Exec(`
+	UPDATE photos SET prev_photo_id = NULL, next_photo_id = NULL
+	`)
+	if err != nil {
+		return err
+	}
+
 	rows, err := tx.Query(`
-	SELECT id, set_id FROM photos ORDER BY set_id, taken_at
+	SELECT id, set_id FROM photos WHERE hidden = 0 ORDER BY set_id, taken_at
 	`)
 	if err != nil {
 		return err
@@ -326,9 +401,9 @@ func updatePhotoSiblings() error {
 
 		if setId == prevSetId && prevId > 0 {
 			updatePrevPhotoStmt.Exec(prevId, id)
-			fmt.Printf("photos id=%d prev_photo_id=%d\n", id, prevId)
+			printf("photos id=%d prev_photo_id=%d\n", id, prevId)
 			updateNextPhotoStmt.Exec(id, prevId)
-			fmt.Printf("photos id=%d next_photo_id=%d\n", prevId, id)
+			printf("photos id=%d next_photo_id=%d\n", prevId, id)
 		}
 
 		prevId = id
@@ -353,7 +428,7 @@ func updateSets() error {
 	}
 
 	photosCountStmt, err := tx.Prepare(`
-	SELECT COUNT(*) FROM photos WHERE set_id = ?
+	SELECT COUNT(*) FROM photos WHERE set_id = ? AND hidden = 0
 	`)
 	if err != nil {
 		return err
@@ -371,7 +446,7 @@ func updateSets() error {
 	defer updateSetStmt.Close()
 
 	rows, err := tx.Query(`
-	SELECT id, set_id, MIN(taken_at) FROM photos GROUP BY set_id
+	SELECT id, set_id, MIN(taken_at) FROM photos WHERE hidden = 0 GROUP BY set_id
 	`)
 	if err != nil {
 		return err
@@ -388,12 +463,22 @@ func updateSets() error {
 		row.Scan(&photosCount)
 
 		updateSetStmt.Exec(photosCount, takenAt, id, setId)
-		fmt.Printf("sets id=%d photos_count=%d taken_at=%q thumb_photo_id=%d\n", setId, photosCount, takenAt.String, id)
+		printf("sets id=%d photos_count=%d taken_at=%q thumb_photo_id=%d\n", setId, photosCount, takenAt.String, id)
 	}
 
 	if err := rows.Err(); err != nil {
 		return err
 	}
+	rows.Close()
+
+	// sets whose photos are all hidden
+	_, err = tx.Exec(`
+	UPDATE sets SET photos_count = 0
+	WHERE id NOT IN (SELECT set_id FROM photos WHERE hidden = 0)
+	`)
+	if err != nil {
+		return err
+	}
 
 	if err := tx.Commit(); err != nil {
 		return err
@@ -403,15 +488,12 @@ func updateSets() error {
 }
 
 func setupDatabase() {
-	var err error
-
-	dbPath := path.Join(os.Getenv("HOME"), ".thyme.db")
-	db, err = sql.Open("sqlite3", dbPath) // := here shadows global db var
+	cfg, err := config.Load()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	_, err = db.Exec(createSchemaSQL)
+	db, err = database.Open(cfg.Database) // := here shadows global db var
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -421,7 +503,10 @@ func setupDatabase() {
 		log.Fatal(err)
 	}
 
-	selectPhotoStmt, err = db.Prepare("SELECT id FROM photos WHERE path = ?")
+	selectPhotoStmt, err = db.Prepare(`
+	SELECT id, size, mtime, content_hash, color_space, dhash FROM photos
+	WHERE path = ?
+	`)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -435,27 +520,68 @@ func setupDatabase() {
 	INSERT INTO photos (
 	aperture, camera, exposure_comp, exposure_time, flash, focal_length,
 	focal_length_35, height, iso, lat, lens, lng, path, set_id, size, taken_at,
-	width
+	width, content_hash, mtime, color_space, dhash
 	)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// placeholders belong to the old contents
+	updateHashStmt, err = db.Prepare(`
+	UPDATE photos SET content_hash = ?1, size = ?2, mtime = ?3,
+	blurhash = CASE WHEN content_hash IS ?1 THEN blurhash END,
+	dominant_color = CASE WHEN content_hash IS ?1 THEN dominant_color END
+	WHERE id = ?4
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	updateColorStmt, err = db.Prepare(`
+	UPDATE photos SET color_space = ? WHERE id = ?
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	updateDHashStmt, err = db.Prepare(`
+	UPDATE photos SET dhash = ? WHERE id = ?
 	`)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func Scan(paths ...string) {
+func Scan(opts ScanOptions, paths ...string) {
+	reporter, quiet = progress.Discard, opts.JSON // changes are listed instead
+	if opts.JSON {
+		reporter = progress.New(true)
+	}
+
 	setupDatabase()
 	defer db.Close()
 	defer selectSetStmt.Close()
 	defer selectPhotoStmt.Close()
 	defer insertSetStmt.Close()
 	defer insertPhotoStmt.Close()
+	defer updateHashStmt.Close()
+	defer updateColorStmt.Close()
+	defer updateDHashStmt.Close()
+
+	reporter.Start("scan", 0) // the number of photos is not known up front
 
+	reporter.Phase("photos", 0)
 	for _, path := range paths {
 		filepath.Walk(path, walkPath)
 	}
 
+	reporter.Phase("siblings", 0)
 	updatePhotoSiblings()
+
+	reporter.Phase("sets", 0)
 	updateSets()
+
+	reporter.Finish()
 }
@@ -0,0 +1,130 @@
+package progress
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cheggaaa/pb"
+	"golang.org/x/term"
+)
+
+// Reporter follows a command through its phases and the items, e.g. photos,
+// it works on. Reporters are safe for concurrent use.
+type Reporter interface {
+	Start(command string, total int) // total items, or 0 if not known
+	Phase(name string, total int)    // a new phase begins
+	Processed(item string)
+	Failed(item string, err error)
+	Finish()
+}
+
+// New returns a reporter that writes newline-delimited JSON events to stdout
+// if asJSON is set, draws a progress bar if stdout is a terminal, or reports
+// nothing otherwise
+func New(asJSON bool) Reporter {
+	if asJSON {
+		return &jsonReporter{enc: json.NewEncoder(os.Stdout)}
+	}
+	if term.IsTerminal(int(os.Stdout.Fd())) {
+		return &barReporter{}
+	}
+	return Discard
+}
+
+type jsonReporter struct {
+	mu                sync.Mutex
+	enc               *json.Encoder
+	startedAt         time.Time
+	processed, failed int
+}
+
+func (r *jsonReporter) emit(event string, attrs map[string]interface{}) {
+	attrs["event"] = event
+	attrs["time"] = time.Now().UTC().Format(time.RFC3339)
+	r.enc.Encode(attrs)
+}
+
+func (r *jsonReporter) Start(command string, total int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.startedAt = time.Now()
+	r.emit("started", map[string]interface{}{"command": command, "total": total})
+}
+
+func (r *jsonReporter) Phase(name string, total int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.emit("phase", map[string]interface{}{"phase": name, "total": total})
+}
+
+func (r *jsonReporter) Processed(item string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.processed++
+	r.emit("processed", map[string]interface{}{"item": item})
+}
+
+func (r *jsonReporter) Failed(item string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failed++
+	r.emit("failed", map[string]interface{}{"item": item, "error": err.Error()})
+}
+
+func (r *jsonReporter) Finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.emit("finished", map[string]interface{}{
+		"processed": r.processed,
+		"failed":    r.failed,
+		"duration":  time.Since(r.startedAt).Seconds(),
+	})
+}
+
+// barReporter draws a bar for each phase with a known number of items,
+// counting processed and failed items alike
+type barReporter struct {
+	bar *pb.ProgressBar
+}
+
+func (r *barReporter) Start(command string, total int) { r.Phase(command, total) }
+
+func (r *barReporter) Phase(name string, total int) {
+	r.Finish()
+	if total > 0 {
+		r.bar = pb.StartNew(total)
+	}
+}
+
+func (r *barReporter) Processed(item string) {
+	if r.bar != nil {
+		r.bar.Increment()
+	}
+}
+
+func (r *barReporter) Failed(item string, err error) { r.Processed(item) }
+
+func (r *barReporter) Finish() {
+	if r.bar != nil {
+		r.bar.Finish()
+		r.bar = nil
+	}
+}
+
+// Discard reports nothing
+var Discard Reporter = nop{}
+
+type nop struct{}
+
+func (nop) Start(command string, total int) {}
+func (nop) Phase(name string, total int)    {}
+func (nop) Processed(item string)           {}
+func (nop) Failed(item string, err error)   {}
+func (nop) Finish()                         {}
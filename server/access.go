@@ -0,0 +1,318 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// visibleSetSQL restricts a query joined with sets to the sets visible to the
+// user given in the :user_id named argument, unless :unrestricted is true.
+// A set is visible if it is public, owned by the user or shared with the user
+// directly or through a group.
+const visibleSetSQL = `(:unrestricted OR sets.public = 1 OR sets.owner_id = :user_id
+	OR EXISTS (
+		SELECT 1 FROM set_grants
+		WHERE set_grants.set_id = sets.id AND (
+			set_grants.user_id = :user_id OR set_grants.group_id IN (
+				SELECT group_id FROM user_group_members WHERE user_id = :user_id
+			)
+		)
+	))`
+
+type Grant struct {
+	Id        int
+	UserName  sql.NullString
+	GroupName sql.NullString
+}
+
+func (g *Grant) MarshalJSON() ([]byte, error) { // implements Marshaler
+	grantMap := map[string]interface{}{
+		"id": g.Id,
+	}
+	grantMap["group"], _ = g.GroupName.Value()
+	grantMap["user"], _ = g.UserName.Value()
+	return json.Marshal(grantMap)
+}
+
+// visibilityArgs returns the named arguments expected by visibleSetSQL. A nil
+// user means authentication is disabled and everything is visible.
+func visibilityArgs(user *User) []interface{} {
+	if user == nil {
+		return []interface{}{sql.Named("unrestricted", true), sql.Named("user_id", nil)}
+	}
+	return []interface{}{sql.Named("unrestricted", user.Admin), sql.Named("user_id", user.Id)}
+}
+
+// requireAdmin responds with 403 to users without administrator rights
+func requireAdmin(h http.Handler) http.Handler {
+	return requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := currentUser(r); user != nil && !user.Admin {
+			forbidden(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
+
+// pathId parses the named path wildcard as an id, responding with 400 if it
+// is not one
+func pathId(name string, w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue(name))
+	if err != nil {
+		badRequest(w, r)
+		return 0, false
+	}
+	return id, true
+}
+
+func setExists(setId int) (bool, error) {
+	var id int
+
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	err := db.QueryRow("SELECT id FROM sets WHERE id = ?", setId).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// lookupId returns the id of the named user or group, or sql.ErrNoRows
+func lookupId(table, name string) (id int, err error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	err = db.QueryRow("SELECT id FROM "+table+" WHERE name = ?", name).Scan(&id)
+	return
+}
+
+func getSetAccess(setId int) (accessMap map[string]interface{}, err error) {
+	var owner sql.NullString
+	var public bool
+
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	err = db.QueryRow(`
+	SELECT users.name, sets.public FROM sets
+	LEFT JOIN users ON sets.owner_id = users.id
+	WHERE sets.id = ?
+	`, setId).Scan(&owner, &public)
+	if err != nil {
+		return
+	}
+
+	rows, err := db.Query(`
+	SELECT set_grants.id, users.name, user_groups.name FROM set_grants
+	LEFT JOIN users ON set_grants.user_id = users.id
+	LEFT JOIN user_groups ON set_grants.group_id = user_groups.id
+	WHERE set_grants.set_id = ?
+	ORDER BY set_grants.id
+	`, setId)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	grants := []*Grant{}
+	for rows.Next() {
+		grant := Grant{}
+		if err = rows.Scan(&grant.Id, &grant.UserName, &grant.GroupName); err != nil {
+			return
+		}
+		grants = append(grants, &grant)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	accessMap = map[string]interface{}{
+		"grants": grants,
+		"public": public,
+		"set_id": setId,
+	}
+	accessMap["owner"], _ = owner.Value()
+
+	return
+}
+
+func writeSetAccess(setId int, w http.ResponseWriter, r *http.Request) {
+	accessMap, err := getSetAccess(setId)
+	if err == sql.ErrNoRows { // set does not exist
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accessMap)
+}
+
+func getSetGrantsHandler(w http.ResponseWriter, r *http.Request) {
+	setId, ok := pathId("id", w, r)
+	if !ok {
+		return
+	}
+	writeSetAccess(setId, w, r)
+}
+
+// createSetGrantHandler shares a set with the user or group given in the
+// "user" or "group" form value
+func createSetGrantHandler(w http.ResponseWriter, r *http.Request) {
+	var userId, groupId sql.NullInt64
+
+	setId, ok := pathId("id", w, r)
+	if !ok {
+		return
+	}
+
+	userName, groupName := r.FormValue("user"), r.FormValue("group")
+	if (userName == "") == (groupName == "") { // need exactly one
+		badRequest(w, r)
+		return
+	}
+
+	if exists, err := setExists(setId); err != nil {
+		internalServerError(w, r, err)
+		return
+	} else if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	var err error
+	if userName != "" {
+		var id int
+		id, err = lookupId("users", userName)
+		userId = sql.NullInt64{Int64: int64(id), Valid: true}
+	} else {
+		var id int
+		id, err = lookupId("user_groups", groupName)
+		groupId = sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+	if err == sql.ErrNoRows { // user or group does not exist
+		badRequest(w, r)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	dbMutex.RLock()
+	_, err = db.Exec(`
+	INSERT INTO set_grants (set_id, user_id, group_id)
+	SELECT ?, ?, ?
+	WHERE NOT EXISTS (
+		SELECT 1 FROM set_grants
+		WHERE set_id = ? AND user_id IS ? AND group_id IS ?
+	)
+	`, setId, userId, groupId, setId, userId, groupId)
+	dbMutex.RUnlock()
+
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	writeSetAccess(setId, w, r)
+}
+
+func deleteSetGrantHandler(w http.ResponseWriter, r *http.Request) {
+	setId, ok := pathId("id", w, r)
+	if !ok {
+		return
+	}
+
+	grantId, ok := pathId("grant_id", w, r)
+	if !ok {
+		return
+	}
+
+	dbMutex.RLock()
+	result, err := db.Exec("DELETE FROM set_grants WHERE id = ? AND set_id = ?", grantId, setId)
+	dbMutex.RUnlock()
+
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 { // grant does not exist
+		http.NotFound(w, r)
+		return
+	}
+
+	writeSetAccess(setId, w, r)
+}
+
+// updateSetAccessHandler changes the owner of a set (empty for none) and
+// whether it is visible to all users, given in the "owner" and "public" form
+// values. Either can be omitted.
+func updateSetAccessHandler(w http.ResponseWriter, r *http.Request) {
+	setId, ok := pathId("id", w, r)
+	if !ok {
+		return
+	}
+
+	if exists, err := setExists(setId); err != nil {
+		internalServerError(w, r, err)
+		return
+	} else if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.ParseForm()
+
+	if _, ok := r.Form["owner"]; ok {
+		var ownerId sql.NullInt64
+
+		if ownerName := r.FormValue("owner"); ownerName != "" {
+			id, err := lookupId("users", ownerName)
+			if err == sql.ErrNoRows { // user does not exist
+				badRequest(w, r)
+				return
+			}
+			if err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+			ownerId = sql.NullInt64{Int64: int64(id), Valid: true}
+		}
+
+		dbMutex.RLock()
+		_, err := db.Exec("UPDATE sets SET owner_id = ? WHERE id = ?", ownerId, setId)
+		dbMutex.RUnlock()
+
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+	}
+
+	if _, ok := r.Form["public"]; ok {
+		public, err := strconv.ParseBool(r.FormValue("public"))
+		if err != nil {
+			badRequest(w, r)
+			return
+		}
+
+		dbMutex.RLock()
+		_, err = db.Exec("UPDATE sets SET public = ? WHERE id = ?", public, setId)
+		dbMutex.RUnlock()
+
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+	}
+
+	writeSetAccess(setId, w, r)
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// setupTestSets adds five sets with a photo each (with the same id) that are
+// visible as follows, besides to administrators: 1 is public, 2 is owned by
+// alice, 3 is granted to bob, 4 is granted to a group carol is in and 5 to
+// nobody
+func setupTestSets(t *testing.T) {
+	mustExec(t, `
+	INSERT INTO users (id, name, password_hash, admin, created_at) VALUES
+	(1, 'boss', '', 1, datetime('now')), (2, 'alice', '', 0, datetime('now')),
+	(3, 'bob', '', 0, datetime('now')), (4, 'carol', '', 0, datetime('now'))
+	`)
+	mustExec(t, `INSERT INTO user_groups (id, name) VALUES (1, 'family')`)
+	mustExec(t, `INSERT INTO user_group_members (group_id, user_id) VALUES (1, 4)`)
+
+	for id := 1; id <= 5; id++ {
+		mustExec(t, `
+		INSERT INTO sets (id, name, thumb_photo_id, photos_count) VALUES (?1, ?2, ?1, 1)
+		`, id, fmt.Sprintf("set%d", id))
+		mustExec(t, `
+		INSERT INTO photos (id, set_id, path, size, width, height, content_hash)
+		VALUES (?1, ?1, ?2, 100, 40, 30, ?3)
+		`, id, fmt.Sprintf("/photos/set%d/%d.jpg", id, id), fmt.Sprintf("%064x", id))
+	}
+	mustExec(t, `UPDATE sets SET public = 1 WHERE id = 1`)
+	mustExec(t, `UPDATE sets SET owner_id = 2 WHERE id = 2`)
+	mustExec(t, `INSERT INTO set_grants (set_id, user_id) VALUES (3, 3)`)
+	mustExec(t, `INSERT INTO set_grants (set_id, group_id) VALUES (4, 1)`)
+}
+
+func TestVisibleSets(t *testing.T) {
+	setupTestDatabase(t, `{"auth": true}`)
+	setupTestSets(t)
+
+	tests := []struct {
+		name string
+		user *User
+		want []int
+	}{
+		{"auth disabled", nil, []int{1, 2, 3, 4, 5}},
+		{"admin", &User{Id: 1, Name: "boss", Admin: true}, []int{1, 2, 3, 4, 5}},
+		{"owner", &User{Id: 2, Name: "alice"}, []int{1, 2}},
+		{"user grant", &User{Id: 3, Name: "bob"}, []int{1, 3}},
+		{"group grant", &User{Id: 4, Name: "carol"}, []int{1, 4}},
+		{"nobody", &User{Id: 5, Name: "dave"}, []int{1}},
+	}
+	for _, tt := range tests {
+		sets, err := getSets(tt.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, set := range sets {
+			got = append(got, set.Id)
+		}
+		if !sameIds(got, tt.want) {
+			t.Errorf("%s: getSets() = %v, want %v", tt.name, got, tt.want)
+		}
+
+		for id := 1; id <= 5; id++ {
+			visible := false
+			for _, want := range tt.want {
+				visible = visible || want == id
+			}
+
+			_, err := getSetById(id, tt.user)
+			if (err == nil) != visible || err != nil && err != sql.ErrNoRows {
+				t.Errorf("%s: getSetById(%d) = %v, want visible %v", tt.name, id, err, visible)
+			}
+			_, err = getPhotoById(id, tt.user)
+			if (err == nil) != visible || err != nil && err != sql.ErrNoRows {
+				t.Errorf("%s: getPhotoById(%d) = %v, want visible %v", tt.name, id, err, visible)
+			}
+			photos, err := getPhotosBySetId(id, tt.user)
+			if err != nil || (len(photos) == 1) != visible {
+				t.Errorf("%s: getPhotosBySetId(%d) = %d photos, %v, want visible %v", tt.name, id, len(photos), err, visible)
+			}
+		}
+	}
+}
+
+// sameIds reports whether a and b hold the same ids in any order
+func sameIds(a, b []int) bool {
+	count := map[int]int{}
+	for _, id := range a {
+		count[id]++
+	}
+	for _, id := range b {
+		count[id]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSetAccessHandlers(t *testing.T) {
+	setupTestDatabase(t, `{"auth": true}`)
+	setupTestSets(t)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		setId   int
+		form    string
+		code    int
+		want    string // in the access JSON
+	}{
+		{"grant to user", createSetGrantHandler, 5, "user=alice", 200, `"grants":[{"group":null,"id":3,"user":"alice"}]`},
+		{"grant again", createSetGrantHandler, 5, "user=alice", 200, `"grants":[{"group":null,"id":3,"user":"alice"}]`},
+		{"grant to group", createSetGrantHandler, 5, "group=family", 200, `{"group":"family","id":4,"user":null}`},
+		{"grant to user and group", createSetGrantHandler, 5, "user=alice&group=family", 400, ""},
+		{"grant to unknown group", createSetGrantHandler, 5, "group=strangers", 400, ""},
+		{"grant on unknown set", createSetGrantHandler, 9, "user=alice", 404, ""},
+		{"make public", updateSetAccessHandler, 3, "public=true", 200, `"public":true`},
+		{"change owner", updateSetAccessHandler, 2, "owner=bob", 200, `"owner":"bob"`},
+		{"remove owner", updateSetAccessHandler, 2, "owner=", 200, `"owner":null`},
+		{"unknown owner", updateSetAccessHandler, 2, "owner=mallory", 400, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(tt.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetPathValue("id", strconv.Itoa(tt.setId))
+		w := httptest.NewRecorder()
+		tt.handler(w, r)
+
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.code)
+		} else if !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: got %s, want %s in it", tt.name, w.Body.String(), tt.want)
+		}
+	}
+
+	// the grants above make set 5 visible to alice and, through her group, to
+	// carol, and set 3 to everyone
+	for _, user := range []*User{{Id: 2, Name: "alice"}, {Id: 4, Name: "carol"}} {
+		if _, err := getSetById(5, user); err != nil {
+			t.Errorf("set 5 for %s: %v", user.Name, err)
+		}
+	}
+	if _, err := getSetById(3, &User{Id: 2, Name: "alice"}); err != nil {
+		t.Errorf("public set 3: %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/agorf/thyme-backend/users"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookieName = "thyme_session"
+	sessionMaxAge     = 30 * 24 * time.Hour
+	csrfHeaderName    = "X-CSRF-Token"
+	csrfFormName      = "csrf_token"
+)
+
+type contextKey int
+
+const userContextKey contextKey = iota
+
+// compared against when a user does not exist so that response times do not
+// reveal which user names exist
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("thyme"), bcrypt.DefaultCost)
+
+type User struct {
+	Id        int
+	Name      string
+	Admin     bool
+	csrfToken string // set only when authenticated with a session cookie
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintln(w, http.StatusUnauthorized, "Unauthorized")
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintln(w, http.StatusForbidden, "Forbidden")
+}
+
+// currentUser returns the authenticated user, or nil if authentication is
+// disabled
+func currentUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey).(*User)
+	return user
+}
+
+func getUserBySession(token string) (user *User, err error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	user = &User{}
+	row := getSessionUserStmt.QueryRow(users.HashToken(token))
+	err = row.Scan(&user.Id, &user.Name, &user.Admin, &user.csrfToken)
+	if err == sql.ErrNoRows { // session does not exist or has expired
+		return nil, nil
+	}
+	return
+}
+
+func getUserByToken(token string) (user *User, err error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	tokenHash := users.HashToken(token)
+
+	user = &User{}
+	err = getTokenUserStmt.QueryRow(tokenHash).Scan(&user.Id, &user.Name, &user.Admin)
+	if err == sql.ErrNoRows { // token does not exist
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	_, err = touchTokenStmt.Exec(tokenHash)
+	return
+}
+
+// authenticate returns the user making the request, preferring an API token
+// over a session cookie, or nil if there is none
+func authenticate(r *http.Request) (*User, error) {
+	if authz := r.Header.Get("Authorization"); strings.HasPrefix(authz, "Bearer ") {
+		return getUserByToken(strings.TrimPrefix(authz, "Bearer "))
+	}
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil { // no session cookie
+		return nil, nil
+	}
+
+	return getUserBySession(cookie.Value)
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// requireAuth responds with 401 to requests without a valid session or API
+// token when authentication is enabled. Unsafe requests authenticated with a
+// session cookie must also carry the session's CSRF token in a header, or in
+// a form value for plain HTML form submissions such as downloads.
+func requireAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !currentConfig.Load().Auth {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := authenticate(r)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if user == nil {
+			unauthorized(w, r)
+			return
+		}
+
+		if user.csrfToken != "" && !isSafeMethod(r.Method) {
+			csrfToken := r.Header.Get(csrfHeaderName)
+			if csrfToken == "" {
+				csrfToken = r.PostFormValue(csrfFormName)
+			}
+			if subtle.ConstantTimeCompare([]byte(csrfToken), []byte(user.csrfToken)) != 1 {
+				forbidden(w, r)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	})
+}
+
+func writeSession(w http.ResponseWriter, user *User) {
+	sessionMap := map[string]interface{}{
+		"auth": currentConfig.Load().Auth,
+	}
+
+	if user != nil {
+		sessionMap["admin"] = user.Admin
+		sessionMap["csrf_token"] = user.csrfToken
+		sessionMap["user"] = user.Name
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessionMap)
+}
+
+func createSession(userId int) (token, csrfToken string, err error) {
+	if token, err = users.GenerateToken(); err != nil {
+		return
+	}
+	if csrfToken, err = users.GenerateToken(); err != nil {
+		return
+	}
+
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	if _, err = deleteExpiredSessionsStmt.Exec(); err != nil {
+		return
+	}
+
+	expiresAt := time.Now().Add(sessionMaxAge).UTC().Format("2006-01-02 15:04:05")
+	_, err = insertSessionStmt.Exec(userId, users.HashToken(token), csrfToken, expiresAt)
+
+	return
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	var passwordHash []byte
+
+	name := r.FormValue("name")
+	password := r.FormValue("password")
+
+	user := &User{}
+
+	dbMutex.RLock()
+	err := getUserByNameStmt.QueryRow(name).Scan(&user.Id, &user.Name, &user.Admin, &passwordHash)
+	dbMutex.RUnlock()
+
+	if err == sql.ErrNoRows { // user does not exist
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		unauthorized(w, r)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) != nil {
+		log.Printf("failed login for user %q from %s", name, r.RemoteAddr)
+		unauthorized(w, r)
+		return
+	}
+
+	token, csrfToken, err := createSession(user.Id)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	user.csrfToken = csrfToken
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessionMaxAge.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	writeSession(w, user)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		dbMutex.RLock()
+		_, err := deleteSessionStmt.Exec(users.HashToken(cookie.Value))
+		dbMutex.RUnlock()
+
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1, // delete
+		HttpOnly: true,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getSessionHandler(w http.ResponseWriter, r *http.Request) {
+	writeSession(w, currentUser(r))
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/agorf/thyme-backend/users"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// setupTestUsers adds the administrator boss (id 1) and alice (id 2), both
+// with the password "pw", and an API token "alice-token" for alice
+func setupTestUsers(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, `
+	INSERT INTO users (id, name, password_hash, admin, created_at) VALUES
+	(1, 'boss', ?1, 1, datetime('now')), (2, 'alice', ?1, 0, datetime('now'))
+	`, string(hash))
+	mustExec(t, `
+	INSERT INTO api_tokens (user_id, name, token_hash, created_at)
+	VALUES (2, 'test', ?, datetime('now'))
+	`, users.HashToken("alice-token"))
+}
+
+// whoami responds with the name of the current user, or "-" if there is none
+var whoami = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if user := currentUser(r); user != nil {
+		fmt.Fprint(w, user.Name)
+	} else {
+		fmt.Fprint(w, "-")
+	}
+})
+
+func TestRequireAuthDisabled(t *testing.T) {
+	setupTestDatabase(t, `{"auth": false}`)
+
+	for _, method := range []string{"GET", "POST"} {
+		w := httptest.NewRecorder()
+		requireAuth(whoami).ServeHTTP(w, httptest.NewRequest(method, "/sets", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "-" {
+			t.Errorf("%s: got %d %q", method, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	setupTestDatabase(t, `{"auth": true}`)
+	setupTestUsers(t)
+
+	session, csrfToken, err := createSession(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, `
+	INSERT INTO sessions (user_id, token_hash, csrf_token, expires_at)
+	VALUES (1, ?, 'old-csrf', datetime('now', '-1 minute'))
+	`, users.HashToken("expired"))
+
+	tests := []struct {
+		name     string
+		method   string
+		bearer   string
+		session  string
+		csrf     string // header
+		csrfForm string
+		code     int
+		user     string
+	}{
+		{"nothing", "GET", "", "", "", "", http.StatusUnauthorized, ""},
+		{"token", "GET", "alice-token", "", "", "", http.StatusOK, "alice"},
+		{"token without csrf", "POST", "alice-token", "", "", "", http.StatusOK, "alice"},
+		{"unknown token", "GET", "bogus", "", "", "", http.StatusUnauthorized, ""},
+		{"token before session", "GET", "bogus", session, "", "", http.StatusUnauthorized, ""},
+		{"session", "GET", "", session, "", "", http.StatusOK, "alice"},
+		{"session without csrf", "POST", "", session, "", "", http.StatusForbidden, ""},
+		{"session with csrf header", "POST", "", session, csrfToken, "", http.StatusOK, "alice"},
+		{"session with csrf form value", "POST", "", session, "", csrfToken, http.StatusOK, "alice"},
+		{"session with wrong csrf", "DELETE", "", session, "old-csrf", "", http.StatusForbidden, ""},
+		{"expired session", "GET", "", "expired", "", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		form := url.Values{}
+		if tt.csrfForm != "" {
+			form.Set(csrfFormName, tt.csrfForm)
+		}
+		r := httptest.NewRequest(tt.method, "/sets", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.bearer)
+		}
+		if tt.session != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: tt.session})
+		}
+		if tt.csrf != "" {
+			r.Header.Set(csrfHeaderName, tt.csrf)
+		}
+
+		w := httptest.NewRecorder()
+		requireAuth(whoami).ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.code)
+		} else if tt.user != "" && w.Body.String() != tt.user {
+			t.Errorf("%s: got user %q, want %q", tt.name, w.Body.String(), tt.user)
+		}
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	setupTestDatabase(t, `{"auth": true}`)
+	setupTestUsers(t)
+
+	bossToken, _, err := createSession(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		auth func(r *http.Request)
+		code int
+	}{
+		{"nobody", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"user", func(r *http.Request) { r.Header.Set("Authorization", "Bearer alice-token") }, http.StatusForbidden},
+		{"admin", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: bossToken}) }, http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/sets/1/grants", nil)
+		tt.auth(r)
+		w := httptest.NewRecorder()
+		requireAdmin(whoami).ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.code)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	setupTestDatabase(t, `{"auth": true}`)
+	setupTestUsers(t)
+
+	tests := []struct {
+		name, user, password string
+		code                 int
+	}{
+		{"right password", "alice", "pw", http.StatusOK},
+		{"wrong password", "alice", "wrong", http.StatusUnauthorized},
+		{"unknown user", "mallory", "pw", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		form := url.Values{"name": {tt.user}, "password": {tt.password}}
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		loginHandler(w, r)
+
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			if len(w.Result().Cookies()) > 0 {
+				t.Errorf("%s: got a session cookie", tt.name)
+			}
+			continue
+		}
+
+		var session struct {
+			User      string `json:"user"`
+			CSRFToken string `json:"csrf_token"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&session); err != nil {
+			t.Fatal(err)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || !cookies[0].HttpOnly || session.User != tt.user || session.CSRFToken == "" {
+			t.Fatalf("%s: got session %+v and cookies %v", tt.name, session, cookies)
+		}
+
+		// the session authenticates later requests
+		user, err := getUserBySession(cookies[0].Value)
+		if err != nil || user == nil || user.Name != tt.user || user.csrfToken != session.CSRFToken {
+			t.Errorf("%s: session user is %+v, %v", tt.name, user, err)
+		}
+	}
+}
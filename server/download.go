@@ -0,0 +1,208 @@
+package server
+
+import (
+	"archive/zip"
+	"database/sql"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// uniqueName returns name, or name with a " (n)" suffix before its extension
+// if it has already been used. Names are compared case-insensitively since
+// archives are often extracted on case-insensitive filesystems.
+func uniqueName(name string, used map[string]bool) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	unique := name
+	for n := 2; used[strings.ToLower(unique)]; n++ {
+		unique = base + " (" + strconv.Itoa(n) + ")" + ext
+	}
+	used[strings.ToLower(unique)] = true
+
+	return unique
+}
+
+// selectPhotos narrows photos down to the ones whose ids are given in "id"
+// form values, if any
+func selectPhotos(photos []*Photo, r *http.Request) ([]*Photo, bool) {
+	r.ParseForm()
+
+	ids := r.PostForm["id"]
+	if len(ids) == 0 {
+		return photos, true
+	}
+
+	selected := map[int]bool{}
+	for _, idParam := range ids {
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			return nil, false
+		}
+		selected[id] = true
+	}
+
+	var selection []*Photo
+	for _, photo := range photos {
+		if selected[photo.Id] {
+			selection = append(selection, photo)
+		}
+	}
+
+	return selection, len(selection) > 0
+}
+
+func writeZipEntry(zw *zip.Writer, filePath, name string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	entry, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store, // JPEGs do not compress further
+		Modified: fi.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, f)
+	return err
+}
+
+// writeZip streams a ZIP archive of the originals or thumbs of photos, as
+// given by the "size" parameter ("original" or a thumb profile name). Files
+// are read one at a time so nothing is buffered besides the copy buffer.
+func writeZip(archiveName string, photos []*Photo, w http.ResponseWriter, r *http.Request) {
+	size := r.FormValue("size")
+	if size == "" {
+		size = "original"
+	} else if size != "original" && !isThumbProfile(size) {
+		badRequest(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": archiveName + ".zip",
+	}))
+
+	zw := zip.NewWriter(w)
+	used := map[string]bool{}
+
+	for _, photo := range photos {
+		filePath, name := photo.Path, photo.Filename()
+		if size != "original" {
+			thumbPath, err := ensureThumb(photo, size, "")
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			filePath = thumbPath
+			name = strings.TrimSuffix(name, path.Ext(name)) + path.Ext(filePath)
+		}
+
+		// the response has started, so failures can only be logged
+		if err := writeZipEntry(zw, filePath, uniqueName(name, used)); err != nil {
+			log.Print(err)
+			if _, ok := err.(*os.PathError); !ok { // client went away
+				return
+			}
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		log.Print(err)
+	}
+}
+
+// downloadSetHandler sends a set as a ZIP archive. POST requests may select
+// photos with "id" form values.
+func downloadSetHandler(w http.ResponseWriter, r *http.Request) {
+	setId, ok := pathId("id", w, r)
+	if !ok {
+		return
+	}
+
+	set, err := getSetById(setId, currentUser(r))
+	if err == sql.ErrNoRows { // set does not exist or is not visible
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	photos, err := getPhotosBySetId(setId, currentUser(r))
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	photos, ok = selectPhotos(photos, r)
+	if !ok {
+		badRequest(w, r)
+		return
+	}
+
+	writeZip(set.Name, photos, w, r)
+}
+
+func downloadSharedHandler(w http.ResponseWriter, r *http.Request) {
+	share, ok := authorizeShare(w, r)
+	if !ok {
+		return
+	}
+
+	if !share.AllowDownload {
+		forbidden(w, r)
+		return
+	}
+
+	photos, err := sharePhotos(share)
+	if err != nil && err != sql.ErrNoRows {
+		internalServerError(w, r, err)
+		return
+	}
+
+	photos, ok = selectPhotos(photos, r)
+	if !ok {
+		badRequest(w, r)
+		return
+	}
+
+	archiveName := "photos"
+	if share.SetId.Valid {
+		set, err := getSetById(int(share.SetId.Int64), nil)
+		if err == sql.ErrNoRows { // set was deleted
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		archiveName = set.Name
+	}
+
+	if err := logShareAccess(share, r); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	writeZip(archiveName, photos, w, r)
+}
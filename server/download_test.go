@@ -0,0 +1,111 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUniqueName(t *testing.T) {
+	used := map[string]bool{}
+
+	tests := []struct {
+		name, want string
+	}{
+		{"IMG_1.jpg", "IMG_1.jpg"},
+		{"IMG_1.jpg", "IMG_1 (2).jpg"},
+		{"img_1.JPG", "img_1 (3).JPG"},
+		{"IMG_1 (2).jpg", "IMG_1 (2) (2).jpg"},
+		{"README", "README"},
+		{"readme", "readme (2)"},
+	}
+	for _, tt := range tests {
+		if got := uniqueName(tt.name, used); got != tt.want {
+			t.Errorf("uniqueName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSelectPhotos(t *testing.T) {
+	photos := []*Photo{{Id: 1}, {Id: 2}, {Id: 3}}
+
+	tests := []struct {
+		name string
+		form string
+		want []int
+		ok   bool
+	}{
+		{"all", "", []int{1, 2, 3}, true},
+		{"some", "id=3&id=1", []int{1, 3}, true},
+		{"unknown", "id=4", nil, false},
+		{"some unknown", "id=2&id=4", []int{2}, true},
+		{"invalid", "id=x", nil, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/sets/1/download", strings.NewReader(tt.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		selection, ok := selectPhotos(photos, r)
+		var got []int
+		for _, photo := range selection {
+			got = append(got, photo.Id)
+		}
+		if !reflect.DeepEqual(got, tt.want) || ok != tt.ok {
+			t.Errorf("%s: got %v, %v, want %v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestWriteZip(t *testing.T) {
+	dir := t.TempDir()
+	var photos []*Photo
+	for i, name := range []string{"a/IMG_1.jpg", "b/IMG_1.jpg", "b/missing.jpg", "b/IMG_2.jpg"} {
+		path := filepath.Join(dir, name)
+		if !strings.Contains(name, "missing") {
+			os.MkdirAll(filepath.Dir(path), 0755)
+			if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		photos = append(photos, &Photo{Id: i + 1, Path: path})
+	}
+
+	w := httptest.NewRecorder()
+	writeZip("Summer, 2024", photos, w, httptest.NewRequest("GET", "/sets/1/download?"+url.Values{"size": {"original"}}.Encode(), nil))
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/zip" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="Summer, 2024.zip"` {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+
+	body := w.Body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// missing files are skipped
+	want := map[string]string{"IMG_1.jpg": "a/IMG_1.jpg", "IMG_1 (2).jpg": "b/IMG_1.jpg", "IMG_2.jpg": "b/IMG_2.jpg"}
+	got := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		got[f.Name] = string(b)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got entries %v, want %v", got, want)
+	}
+}
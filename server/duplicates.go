@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/agorf/thyme-backend/photos"
+)
+
+// findDuplicates returns the groups of duplicates found with a threshold.
+// The database is only held while the photos are read, not while they are
+// compared, which takes a while for large libraries.
+func findDuplicates(threshold int) ([]photos.DuplicateGroup, error) {
+	dbMutex.RLock()
+	contents, err := photos.DuplicateCandidates(db)
+	dbMutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return photos.GroupDuplicates(contents, threshold), nil
+}
+
+// getDuplicatesHandler lists groups of exact copies and near-duplicates, the
+// latter with difference hashes at most "threshold" bits apart, with the best
+// photo of each group first
+func getDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	threshold := photos.DefaultDuplicateThreshold
+	if s := r.FormValue("threshold"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > 64 {
+			badRequest(w, r)
+			return
+		}
+		threshold = n
+	}
+
+	groups, err := findDuplicates(threshold)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	cfg := currentConfig.Load()
+
+	list := []map[string]interface{}{}
+	for _, group := range groups {
+		groupPhotos := []map[string]interface{}{}
+		for _, p := range group.Photos {
+			photo := Photo{Path: p.Path}
+			photo.redact(cfg, currentUser(r) == nil)
+
+			groupPhoto := map[string]interface{}{
+				"photo_id": p.Id,
+				"set_id":   p.SetId,
+				"width":    p.Width,
+				"height":   p.Height,
+				"size":     p.Size,
+			}
+			groupPhoto["path"], _ = photo.displayPath.Value()
+			groupPhotos = append(groupPhotos, groupPhoto)
+		}
+
+		list = append(list, map[string]interface{}{
+			"kind":   group.Kind,
+			"photos": groupPhotos,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// parseFraction parses a focus coordinate, which must lie within the photo
+func parseFraction(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || f > 1 {
+		return 0, false
+	}
+	return f, true
+}
+
+// setPhotoFocus sets the focus of the contents of a photo, which its copies
+// share along with its thumbs, or clears it if x and y are null
+func setPhotoFocus(photo *Photo, x, y sql.NullFloat64) error {
+	if !photo.ContentHash.Valid {
+		return errNotHashed
+	}
+
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	if !x.Valid || !y.Valid {
+		_, err := db.Exec("DELETE FROM focal_points WHERE content_hash = ?", photo.ContentHash.String)
+		return err
+	}
+
+	_, err := db.Exec(`
+	INSERT INTO focal_points (content_hash, focal_x, focal_y) VALUES (?, ?, ?)
+	ON CONFLICT (content_hash) DO UPDATE SET
+	focal_x = excluded.focal_x, focal_y = excluded.focal_y
+	`, photo.ContentHash.String, x, y)
+	return err
+}
+
+// updatePhotoFocusHandler sets (PUT, with x and y form values) or clears
+// (DELETE) the point of a photo that cropped thumbs keep in view, responding
+// with the photo, whose cropped thumbs have new URLs
+func updatePhotoFocusHandler(w http.ResponseWriter, r *http.Request) {
+	photoId, ok := pathId("id", w, r)
+	if !ok {
+		return
+	}
+
+	var x, y sql.NullFloat64
+	if r.Method == http.MethodPut {
+		x.Float64, x.Valid = parseFraction(r.FormValue("x"))
+		y.Float64, y.Valid = parseFraction(r.FormValue("y"))
+		if !x.Valid || !y.Valid {
+			badRequest(w, r)
+			return
+		}
+	}
+
+	photo, err := getPhotoById(photoId, currentUser(r))
+	if err == sql.ErrNoRows { // photo does not exist or is not visible
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	if err := setPhotoFocus(photo, x, y); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	photo.FocalX, photo.FocalY = x, y
+
+	photo.redact(currentConfig.Load(), currentUser(r) == nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(photo)
+}
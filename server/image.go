@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/agorf/thyme-backend/thumb"
+	"github.com/agorf/thyme-backend/thumbs"
+)
+
+var imageFormatExts = map[string]string{
+	"jpeg": ".jpg",
+	"webp": ".webp",
+}
+
+type imageParams struct {
+	width  int
+	height int
+	fit    string // "contain" or "cover"
+	format string
+}
+
+func isImageSize(size int) bool {
+	for _, s := range currentConfig.Load().ImageSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// parseImageParams reads the w, h, fit and format parameters. Only sizes in
+// the image_sizes setting are accepted so that the cache cannot be filled
+// with arbitrary sizes.
+func parseImageParams(r *http.Request) (params imageParams, ok bool) {
+	query := r.URL.Query()
+
+	for _, dim := range []struct {
+		name  string
+		value *int
+	}{{"w", &params.width}, {"h", &params.height}} {
+		if query.Get(dim.name) == "" {
+			continue
+		}
+
+		size, err := strconv.Atoi(query.Get(dim.name))
+		if err != nil || !isImageSize(size) {
+			return params, false
+		}
+		*dim.value = size
+	}
+
+	if params.width == 0 && params.height == 0 {
+		return params, false
+	}
+
+	params.fit = query.Get("fit")
+	switch params.fit {
+	case "":
+		params.fit = "contain"
+	case "contain":
+	case "cover":
+		if params.width == 0 || params.height == 0 {
+			return params, false
+		}
+	default:
+		return params, false
+	}
+
+	params.format = query.Get("format")
+	if params.format == "" {
+		params.format = "jpeg"
+	}
+	if _, ok := imageFormatExts[params.format]; !ok {
+		return params, false
+	}
+
+	return params, true
+}
+
+// Srcset returns the resized images available for a photo, for use in an img
+// srcset attribute. Sizes larger than the photo are left out.
+func (p *Photo) Srcset() []map[string]interface{} {
+	srcset := []map[string]interface{}{}
+	imageURL := path.Join(p.baseURL, "photos", strconv.Itoa(p.Id), "image")
+
+	for _, width := range currentConfig.Load().ImageSizes {
+		if int64(width) > p.Width {
+			continue
+		}
+
+		srcset = append(srcset, map[string]interface{}{
+			"height": int64(math.Floor(float64(width)*float64(p.Height)/float64(p.Width) + .5)),
+			"url":    fmt.Sprintf("%s?w=%d", imageURL, width),
+			"width":  width,
+		})
+	}
+
+	return srcset
+}
+
+// serveImage serves a resized rendition of a photo, generating and caching it
+// on first request
+func serveImage(photo *Photo, w http.ResponseWriter, r *http.Request) {
+	params, ok := parseImageParams(r)
+	if !ok {
+		badRequest(w, r)
+		return
+	}
+
+	if !thumbGen.Load().CanWrite(params.format) {
+		http.Error(w, fmt.Sprintf("format %s is not supported by the thumbnailer", params.format),
+			http.StatusBadRequest)
+		return
+	}
+
+	if !photo.ContentHash.Valid {
+		internalServerError(w, r, errNotHashed)
+		return
+	}
+
+	fit := params.fit
+	if focus := photo.focus(); fit == "cover" && focus != nil {
+		fit += fmt.Sprintf("-%g-%g", focus.X, focus.Y) // crops follow the focus
+	}
+
+	// the database is only held while preparing and recording the image, not
+	// while rendering it, so that reloads do not wait for renders
+	dbMutex.RLock()
+	g := thumbGen.Load()
+	if watermarked(photo.shared) {
+		fit += "-wm" + g.Watermark.Version()
+	}
+	source := photo.thumbsPhoto()
+	hash, err := g.CurrentHash(source)
+	dbMutex.RUnlock()
+
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	source.Hash = hash
+	basename := fmt.Sprintf("%s_%dx%d_%s%s", hash,
+		params.width, params.height, fit, imageFormatExts[params.format])
+	imagePath := filepath.Join(thumbsPath, thumbs.SizedDir, thumb.Path(basename))
+	job := g.ResizeJob(source, imagePath, params.width, params.height, params.fit == "cover")
+
+	if !job.Current() {
+		_, err = generateOnce(basename, func(ctx context.Context) (string, error) {
+			if err := g.Render(ctx, job); err != nil {
+				return "", err
+			}
+
+			dbMutex.RLock()
+			defer dbMutex.RUnlock()
+
+			return imagePath, thumbGen.Load().Record(job)
+		})
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	http.ServeFile(w, r, imagePath)
+}
+
+func getPhotoImageHandler(w http.ResponseWriter, r *http.Request) {
+	photoId, ok := pathId("id", w, r)
+	if !ok {
+		return
+	}
+
+	photo, err := getPhotoById(photoId, currentUser(r))
+	if err == sql.ErrNoRows { // photo does not exist or is not visible
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	serveImage(photo, w, r)
+}
+
+func getSharedImageHandler(w http.ResponseWriter, r *http.Request) {
+	share, ok := authorizeShare(w, r)
+	if !ok {
+		return
+	}
+
+	photoId, ok := pathId("id", w, r)
+	if !ok {
+		return
+	}
+
+	photo, ok := findSharedPhoto(share, photoId, "", w, r)
+	if !ok {
+		return
+	}
+
+	serveImage(photo, w, r)
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/agorf/thyme-backend/config"
+)
+
+const defaultListenAddr = "127.0.0.1:9292"
+
+// first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+type Options struct {
+	ListenAddr  string // TCP address, e.g. "0.0.0.0:9292"
+	SocketPath  string // Unix domain socket path, takes precedence over ListenAddr
+	TLSCertPath string
+	TLSKeyPath  string
+}
+
+// withConfig fills in the options not given on the command line
+func (opts Options) withConfig(cfg *config.Config) Options {
+	if opts.ListenAddr == "" {
+		opts.ListenAddr = cfg.Listen
+	}
+	if opts.SocketPath == "" {
+		opts.SocketPath = cfg.Socket
+	}
+	if opts.TLSCertPath == "" {
+		opts.TLSCertPath = cfg.TLSCert
+	}
+	if opts.TLSKeyPath == "" {
+		opts.TLSKeyPath = cfg.TLSKey
+	}
+	return opts
+}
+
+// reloads the certificate whenever the certificate or key file changes
+type certReloader struct {
+	certPath string
+	keyPath  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	cr := &certReloader{certPath: certPath, keyPath: keyPath}
+	if _, err := cr.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// setPaths switches to a different certificate and key, loaded on the next
+// handshake
+func (cr *certReloader) setPaths(certPath, keyPath string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if certPath != cr.certPath || keyPath != cr.keyPath {
+		cr.certPath = certPath
+		cr.keyPath = keyPath
+		cr.modTime = time.Time{} // force reload
+	}
+}
+
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, filePath := range []string{cr.certPath, cr.keyPath} {
+		fi, err := os.Stat(filePath)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) { // used by tls.Config
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	modTime, err := cr.latestModTime()
+	if err != nil && cr.cert == nil {
+		return nil, err
+	}
+	if err != nil || !modTime.After(cr.modTime) { // unchanged or being replaced
+		return cr.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		if cr.cert == nil {
+			return nil, err
+		}
+		return cr.cert, nil // keep serving the previous certificate
+	}
+
+	cr.cert = &cert
+	cr.modTime = modTime
+
+	return cr.cert, nil
+}
+
+// systemdListener returns the socket passed by systemd socket activation, or
+// nil if the process was not socket-activated
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	if fds > 1 {
+		return nil, errors.New("systemd passed more than one socket")
+	}
+
+	// do not pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(listenFdsStart, "systemd")
+	defer f.Close() // net.FileListener dups the descriptor
+
+	return net.FileListener(f)
+}
+
+func unixListener(socketPath string) (net.Listener, error) {
+	if fi, err := os.Stat(socketPath); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		os.Remove(socketPath) // stale socket from a previous run
+	}
+
+	return net.Listen("unix", socketPath)
+}
+
+func listen(opts Options) (ln net.Listener, err error) {
+	ln, err = systemdListener()
+	if err != nil || ln != nil {
+		return
+	}
+
+	if opts.SocketPath != "" {
+		return unixListener(opts.SocketPath)
+	}
+
+	listenAddr := opts.ListenAddr
+	if listenAddr == "" {
+		listenAddr = defaultListenAddr
+	}
+
+	return net.Listen("tcp", listenAddr)
+}
+
+func listenURL(ln net.Listener, opts Options) string {
+	if ln.Addr().Network() == "unix" {
+		return fmt.Sprintf("unix:%s", ln.Addr())
+	}
+
+	if opts.TLSCertPath != "" {
+		return fmt.Sprintf("https://%s", ln.Addr())
+	}
+
+	return fmt.Sprintf("http://%s", ln.Addr())
+}
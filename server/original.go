@@ -0,0 +1,91 @@
+package server
+
+import (
+	"database/sql"
+	"mime"
+	"net/http"
+	"os"
+)
+
+// serveOriginal streams a photo file from where it was scanned, handling
+// Range and conditional requests. Callers look photos up by id so that only
+// paths registered in the photos table are ever opened.
+func serveOriginal(photo *Photo, w http.ResponseWriter, r *http.Request) {
+	f, err := os.Open(photo.Path)
+	if os.IsNotExist(err) { // moved or deleted since it was scanned
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	disposition := "inline"
+	if r.URL.Query().Get("download") != "" {
+		disposition = "attachment"
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{
+		"filename": photo.Filename(),
+	}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	http.ServeContent(w, r, photo.Filename(), fi.ModTime(), f)
+}
+
+func getPhotoOriginalHandler(w http.ResponseWriter, r *http.Request) {
+	photoId, ok := pathId("id", w, r)
+	if !ok {
+		return
+	}
+
+	photo, err := getPhotoById(photoId, currentUser(r))
+	if err == sql.ErrNoRows { // photo does not exist or is not visible
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	serveOriginal(photo, w, r)
+}
+
+// getSharedOriginalHandler serves originals of the photos in a share if it
+// allows downloads
+func getSharedOriginalHandler(w http.ResponseWriter, r *http.Request) {
+	share, ok := authorizeShare(w, r)
+	if !ok {
+		return
+	}
+
+	if !share.AllowDownload {
+		forbidden(w, r)
+		return
+	}
+
+	photoId, ok := pathId("id", w, r)
+	if !ok {
+		return
+	}
+
+	photo, ok := findSharedPhoto(share, photoId, "", w, r)
+	if !ok {
+		return
+	}
+
+	serveOriginal(photo, w, r)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/agorf/thyme-backend/config"
+)
+
+// relativePath returns photoPath relative to the library root containing it,
+// or just its set directory and file name if no root does
+func relativePath(photoPath string, roots []string) string {
+	absPath, err := filepath.Abs(photoPath)
+	if err == nil {
+		for _, root := range roots {
+			absRoot, err := filepath.Abs(root)
+			if err != nil {
+				continue
+			}
+
+			rel, err := filepath.Rel(absRoot, absPath)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return filepath.ToSlash(rel)
+			}
+		}
+	}
+
+	return path.Join(filepath.Base(filepath.Dir(photoPath)), filepath.Base(photoPath))
+}
+
+// redact decides which details of a photo are revealed according to the
+// privacy settings. Anonymous viewers are those of share links and, when
+// authentication is disabled, everyone.
+func (p *Photo) redact(cfg *config.Config, anonymous bool) {
+	switch cfg.Privacy.Path {
+	case "absolute":
+		p.displayPath.String, p.displayPath.Valid = p.Path, true
+	case "none":
+		p.displayPath.Valid = false
+	default: // relative
+		p.displayPath.String, p.displayPath.Valid = relativePath(p.Path, cfg.LibraryRoots), true
+	}
+
+	p.showGPS = cfg.Privacy.GPS == "everyone" || !anonymous
+}
+
+func redactPhotos(photos []*Photo, anonymous bool) {
+	cfg := currentConfig.Load()
+	for _, photo := range photos {
+		photo.redact(cfg, anonymous)
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -11,44 +12,73 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/agorf/thyme-backend/config"
+	"github.com/agorf/thyme-backend/database"
 	"github.com/agorf/thyme-backend/thumb"
+	"github.com/agorf/thyme-backend/thumbs"
 	"github.com/gorilla/handlers"
-	_ "github.com/mattn/go-sqlite3"
-)
-
-const (
-	listenAddr   = "127.0.0.1:9292"
-	bigThumbSize = 1000
 )
 
 var (
+	thumbsPath    string // filesystem path of the thumbs directory
+	currentConfig atomic.Pointer[config.Config]
+	dbMutex       sync.RWMutex // guards db and prepared statements on reload
 	db            *sql.DB
+	preparedStmts []*sql.Stmt
 	getSetStmt    *sql.Stmt
 	getSetsStmt   *sql.Stmt
 	getPhotoStmt  *sql.Stmt
 	getPhotosStmt *sql.Stmt
+
+	getPhotoByHashStmt *sql.Stmt
+	getSharedPhotoStmt *sql.Stmt
+
+	getUserByNameStmt         *sql.Stmt
+	getSessionUserStmt        *sql.Stmt
+	getTokenUserStmt          *sql.Stmt
+	touchTokenStmt            *sql.Stmt
+	insertSessionStmt         *sql.Stmt
+	deleteSessionStmt         *sql.Stmt
+	deleteExpiredSessionsStmt *sql.Stmt
 )
 
 type Set struct {
-	Id             int
-	Name           string
-	PhotosCount    int
-	TakenAt        sql.NullString
-	ThumbPhotoId   int
-	ThumbPhotoPath string
+	Id                      int
+	Name                    string
+	PhotosCount             int
+	TakenAt                 sql.NullString
+	ThumbPhotoId            int
+	ThumbPhotoHash          sql.NullString // content hash of the thumb photo
+	ThumbPhotoFocalX        sql.NullFloat64
+	ThumbPhotoFocalY        sql.NullFloat64
+	ThumbPhotoBlurHash      sql.NullString
+	ThumbPhotoDominantColor sql.NullString
+	baseURL                 string // URL path prefix of links, e.g. of a share link
+	shared                  bool   // served through a share link
 }
 
 type Photo struct {
 	Aperture      sql.NullFloat64
+	BlurHash      sql.NullString
 	Camera        sql.NullString
+	ColorSpace    sql.NullString
+	ContentHash   sql.NullString
+	DominantColor sql.NullString
 	ExposureComp  sql.NullInt64
 	ExposureTime  sql.NullFloat64
 	Flash         sql.NullString
 	FocalLength   sql.NullFloat64
 	FocalLength35 sql.NullInt64
+	FocalX        sql.NullFloat64
+	FocalY        sql.NullFloat64
 	Height        int64
+	Hidden        bool
 	ISO           sql.NullInt64
 	Id            int
 	Lat           sql.NullFloat64
@@ -61,6 +91,10 @@ type Photo struct {
 	Size          int
 	TakenAt       sql.NullString
 	Width         int64
+	baseURL       string // URL path prefix of links, e.g. of a share link
+	displayPath   sql.NullString
+	showGPS       bool
+	shared        bool // served through a share link
 }
 
 // used by scanSet and scanPhoto to accept row(s)
@@ -68,12 +102,37 @@ type rowScanner interface {
 	Scan(dest ...interface{}) error
 }
 
-func urlPath(photoPath, suffix string) string {
-	return path.Join("", "thumbs", thumb.Basename(photoPath, suffix))
+// focus returns the focus of a photo, if it has one
+func focus(x, y sql.NullFloat64) *thumb.Focus {
+	if !x.Valid || !y.Valid {
+		return nil
+	}
+	return &thumb.Focus{X: x.Float64, Y: y.Float64}
+}
+
+// watermarked reports whether images served through share links, if shared
+// is set, carry the watermark
+func watermarked(shared bool) bool {
+	wm := thumbGen.Load().Watermark
+	return shared && wm != nil && wm.Shares
+}
+
+// urlPath returns the URL path of a thumb, or "" for photos that have not
+// been hashed yet
+func urlPath(baseURL string, photo thumbs.Photo, profile string) string {
+	if photo.Hash == "" {
+		return ""
+	}
+	basename, _ := thumbGen.Load().Basename(photo, profile, "")
+	return path.Join(baseURL, "thumbs", thumb.Path(basename))
 }
 
 func (s *Set) ThumbURL() string {
-	return urlPath(s.ThumbPhotoPath, "small")
+	return urlPath(s.baseURL, thumbs.Photo{
+		Hash:      s.ThumbPhotoHash.String,
+		Focus:     focus(s.ThumbPhotoFocalX, s.ThumbPhotoFocalY),
+		Watermark: watermarked(s.shared),
+	}, "small")
 }
 
 func (s *Set) MarshalJSON() ([]byte, error) { // implements Marshaler
@@ -85,6 +144,8 @@ func (s *Set) MarshalJSON() ([]byte, error) { // implements Marshaler
 		"thumb_url":      s.ThumbURL(),
 	}
 	setMap["taken_at"], _ = s.TakenAt.Value()
+	setMap["thumb_blurhash"], _ = s.ThumbPhotoBlurHash.Value()
+	setMap["thumb_dominant_color"], _ = s.ThumbPhotoDominantColor.Value()
 	return json.Marshal(setMap)
 }
 
@@ -93,30 +154,45 @@ func (p *Photo) AspectRatio() [2]int64 {
 	return [2]int64{p.Width / gcd, p.Height / gcd}
 }
 
-func (p *Photo) BigThumbHeight() int64 {
-	if p.Orientation() == "portrait" {
-		if p.Height < bigThumbSize {
-			return p.Height
+// ThumbSize returns the dimensions of the thumb of a photo rendered with a
+// profile
+func (p *Photo) ThumbSize(profile config.ThumbProfile) (width, height int64) {
+	size := int64(profile.Size)
+
+	if profile.Crop != "" {
+		if profile.Upscale {
+			return size, size
 		}
+		return min(size, p.Width), min(size, p.Height)
+	}
+
+	if p.Width <= 0 || p.Height <= 0 { // unknown
+		return 0, 0
+	}
 
-		return bigThumbSize
+	scale := float64(size) / float64(max(p.Width, p.Height))
+	if scale > 1 && !profile.Upscale {
+		scale = 1
 	}
 
-	aspectRatio := p.AspectRatio()
-	return int64(math.Floor((float64(aspectRatio[1])/float64(aspectRatio[0]))*float64(p.BigThumbWidth()) + .5))
+	return int64(math.Floor(float64(p.Width)*scale + .5)),
+		int64(math.Floor(float64(p.Height)*scale + .5))
 }
 
-func (p *Photo) BigThumbWidth() int64 {
-	if p.Orientation() == "portrait" {
-		aspectRatio := p.AspectRatio()
-		return int64(math.Floor((float64(aspectRatio[0])/float64(aspectRatio[1]))*float64(p.BigThumbHeight()) + .5))
-	}
+// Thumbs lists the thumbs of a photo by profile name
+func (p *Photo) Thumbs() map[string]interface{} {
+	thumbs := map[string]interface{}{}
 
-	if p.Width < bigThumbSize {
-		return p.Width
+	for name, profile := range thumbGen.Load().Profiles {
+		width, height := p.ThumbSize(profile)
+		thumbs[name] = map[string]interface{}{
+			"height": height,
+			"url":    p.ThumbURL(name),
+			"width":  width,
+		}
 	}
 
-	return bigThumbSize
+	return thumbs
 }
 
 func (p *Photo) Filename() string {
@@ -130,42 +206,57 @@ func (p *Photo) Orientation() string {
 	return "landscape"
 }
 
-func (p *Photo) ThumbURL(suffix string) string {
-	return urlPath(p.Path, suffix)
+func (p *Photo) ThumbURL(profile string) string {
+	return urlPath(p.baseURL, p.thumbsPhoto(), profile)
 }
 
 func (p *Photo) MarshalJSON() ([]byte, error) { // implements Marshaler
 	photoMap := map[string]interface{}{
-		"aspect_ratio":     p.AspectRatio(),
-		"big_thumb_height": p.BigThumbHeight(),
-		"big_thumb_url":    p.ThumbURL("big"),
-		"big_thumb_width":  p.BigThumbWidth(),
-		"filename":         p.Filename(),
-		"height":           p.Height,
-		"id":               p.Id,
-		"orientation":      p.Orientation(),
-		"path":             p.Path,
-		"set_id":           p.SetId,
-		"size":             p.Size,
-		"small_thumb_url":  p.ThumbURL("small"),
-		"width":            p.Width,
+		"aspect_ratio":    p.AspectRatio(),
+		"big_thumb_url":   p.ThumbURL("big"),
+		"filename":        p.Filename(),
+		"height":          p.Height,
+		"hidden":          p.Hidden,
+		"id":              p.Id,
+		"orientation":     p.Orientation(),
+		"set_id":          p.SetId,
+		"size":            p.Size,
+		"small_thumb_url": p.ThumbURL("small"),
+		"srcset":          p.Srcset(),
+		"thumbs":          p.Thumbs(),
+		"width":           p.Width,
 	}
+	photoMap["big_thumb_width"], photoMap["big_thumb_height"] =
+		p.ThumbSize(thumbGen.Load().Profiles["big"])
 
 	photoMap["aperture"], _ = p.Aperture.Value()
+	photoMap["blurhash"], _ = p.BlurHash.Value()
 	photoMap["camera"], _ = p.Camera.Value()
+	photoMap["color_space"], _ = p.ColorSpace.Value()
+	photoMap["dominant_color"], _ = p.DominantColor.Value()
 	photoMap["exposure_comp"], _ = p.ExposureComp.Value()
 	photoMap["exposure_time"], _ = p.ExposureTime.Value()
 	photoMap["flash"], _ = p.Flash.Value()
 	photoMap["focal_length"], _ = p.FocalLength.Value()
 	photoMap["focal_length_35"], _ = p.FocalLength35.Value()
+	photoMap["focus"] = nil
+	if focus := p.focus(); focus != nil {
+		photoMap["focus"] = map[string]float64{"x": focus.X, "y": focus.Y}
+	}
 	photoMap["iso"], _ = p.ISO.Value()
-	photoMap["lat"], _ = p.Lat.Value()
 	photoMap["lens"], _ = p.Lens.Value()
-	photoMap["lng"], _ = p.Lng.Value()
 	photoMap["next_photo_id"], _ = p.NextPhotoId.Value()
+	photoMap["path"], _ = p.displayPath.Value()
 	photoMap["prev_photo_id"], _ = p.PrevPhotoId.Value()
 	photoMap["taken_at"], _ = p.TakenAt.Value()
 
+	if p.showGPS {
+		photoMap["lat"], _ = p.Lat.Value()
+		photoMap["lng"], _ = p.Lng.Value()
+	} else {
+		photoMap["lat"], photoMap["lng"] = nil, nil
+	}
+
 	return json.Marshal(photoMap)
 }
 
@@ -195,19 +286,29 @@ func scanSet(row rowScanner, set *Set) error {
 		&set.PhotosCount,
 		&set.TakenAt,
 		&set.ThumbPhotoId,
-		&set.ThumbPhotoPath,
+		&set.ThumbPhotoHash,
+		&set.ThumbPhotoFocalX,
+		&set.ThumbPhotoFocalY,
+		&set.ThumbPhotoBlurHash,
+		&set.ThumbPhotoDominantColor,
 	)
 }
 
-func getSetById(setId int) (set *Set, err error) {
+func getSetById(setId int, user *User) (set *Set, err error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
 	set = &Set{}
-	row := getSetStmt.QueryRow(setId)
+	row := getSetStmt.QueryRow(append(visibilityArgs(user), sql.Named("id", setId))...)
 	err = scanSet(row, set)
 	return
 }
 
-func getSets() (sets []*Set, err error) {
-	rows, err := getSetsStmt.Query()
+func getSets(user *User) (sets []*Set, err error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	rows, err := getSetsStmt.Query(visibilityArgs(user)...)
 	if err != nil {
 		return
 	}
@@ -229,13 +330,20 @@ func getSets() (sets []*Set, err error) {
 func scanPhoto(row rowScanner, photo *Photo) error {
 	return row.Scan(
 		&photo.Aperture,
+		&photo.BlurHash,
 		&photo.Camera,
+		&photo.ColorSpace,
+		&photo.ContentHash,
+		&photo.DominantColor,
 		&photo.ExposureComp,
 		&photo.ExposureTime,
 		&photo.Flash,
 		&photo.FocalLength,
 		&photo.FocalLength35,
+		&photo.FocalX,
+		&photo.FocalY,
 		&photo.Height,
+		&photo.Hidden,
 		&photo.Id,
 		&photo.ISO,
 		&photo.Lat,
@@ -251,15 +359,32 @@ func scanPhoto(row rowScanner, photo *Photo) error {
 	)
 }
 
-func getPhotoById(photoId int) (photo *Photo, err error) {
+func getPhotoById(photoId int, user *User) (photo *Photo, err error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	photo = &Photo{}
+	row := getPhotoStmt.QueryRow(append(visibilityArgs(user), sql.Named("id", photoId))...)
+	err = scanPhoto(row, photo)
+	return
+}
+
+// getPhotoByHash returns a visible photo with the given content hash
+func getPhotoByHash(contentHash string, user *User) (photo *Photo, err error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
 	photo = &Photo{}
-	row := getPhotoStmt.QueryRow(photoId)
+	row := getPhotoByHashStmt.QueryRow(append(visibilityArgs(user), sql.Named("hash", contentHash))...)
 	err = scanPhoto(row, photo)
 	return
 }
 
-func getPhotosBySetId(setId int) (photos []*Photo, err error) {
-	rows, err := getPhotosStmt.Query(setId)
+func getPhotosBySetId(setId int, user *User) (photos []*Photo, err error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	rows, err := getPhotosStmt.Query(append(visibilityArgs(user), sql.Named("id", setId))...)
 	if err != nil {
 		return
 	}
@@ -288,7 +413,7 @@ func getSetHandler(w http.ResponseWriter, r *http.Request) {
 		log.Fatal(err)
 	}
 
-	set, err := getSetById(setId)
+	set, err := getSetById(setId, currentUser(r))
 	if err == sql.ErrNoRows { // set does not exist
 		http.NotFound(w, r)
 		return
@@ -303,7 +428,7 @@ func getSetHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func getSetsHandler(w http.ResponseWriter, r *http.Request) {
-	sets, err := getSets()
+	sets, err := getSets(currentUser(r))
 	if err != nil {
 		internalServerError(w, r, err)
 		return
@@ -322,7 +447,7 @@ func getPhotoHandler(w http.ResponseWriter, r *http.Request) {
 		log.Fatal(err)
 	}
 
-	photo, err := getPhotoById(photoId)
+	photo, err := getPhotoById(photoId, currentUser(r))
 	if err == sql.ErrNoRows { // photo does not exist
 		http.NotFound(w, r)
 		return
@@ -332,6 +457,8 @@ func getPhotoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	photo.redact(currentConfig.Load(), currentUser(r) == nil)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(photo)
 }
@@ -346,81 +473,276 @@ func getPhotosHandler(w http.ResponseWriter, r *http.Request) {
 		log.Fatal(err)
 	}
 
-	photos, err := getPhotosBySetId(setId)
+	photos, err := getPhotosBySetId(setId, currentUser(r))
 	if err != nil {
 		internalServerError(w, r, err)
 		return
 	}
+	redactPhotos(photos, currentUser(r) == nil)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(photos)
 }
 
-func setupDatabase() {
-	var err error
+// setupDatabase opens the database, prepares all statements and sets up the
+// thumb generator, which records thumbs in the database, replacing the ones
+// in use only if everything succeeds
+func setupDatabase(cfg *config.Config) error {
+	thumbnailer, err := thumbs.NewThumbnailer(cfg.Thumbnailer)
+	if err != nil {
+		return err
+	}
 
-	dbPath := path.Join(os.Getenv("HOME"), ".thyme.db")
-	db, err = sql.Open("sqlite3", dbPath) // := here shadows global db var
+	newDb, err := database.Open(cfg.Database)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	setAttrs := `sets.id, name, photos_count, sets.taken_at, thumb_photo_id,
-	photos.path`
+	photos.content_hash, focal_x, focal_y, photos.blurhash,
+	photos.dominant_color`
+
+	photoAttrs := `aperture, blurhash, camera, color_space, photos.content_hash,
+	dominant_color, exposure_comp, exposure_time, flash, focal_length, focal_length_35, focal_x, focal_y, height, hidden, photos.id, iso, lat, lens, lng,
+	(SELECT id FROM photos AS next
+	 WHERE next.id = photos.next_photo_id AND next.set_id = photos.set_id),
+	path,
+	(SELECT id FROM photos AS prev
+	 WHERE prev.id = photos.prev_photo_id AND prev.set_id = photos.set_id),
+	set_id, size, photos.taken_at, width`
+
+	queries := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&getSetStmt, fmt.Sprintf(`
+		SELECT %s FROM sets
+		JOIN photos ON sets.thumb_photo_id = photos.id
+		LEFT JOIN focal_points ON focal_points.content_hash = photos.content_hash
+		WHERE sets.id = :id AND %s
+		`, setAttrs, visibleSetSQL)},
+		{&getSetsStmt, fmt.Sprintf(`
+		SELECT %s FROM sets
+		JOIN photos ON sets.thumb_photo_id = photos.id
+		LEFT JOIN focal_points ON focal_points.content_hash = photos.content_hash
+		WHERE %s
+		ORDER BY sets.taken_at DESC
+		`, setAttrs, visibleSetSQL)},
+		{&getPhotoStmt, fmt.Sprintf(`
+		SELECT %s FROM photos
+		JOIN sets ON photos.set_id = sets.id
+		LEFT JOIN focal_points ON focal_points.content_hash = photos.content_hash
+		WHERE photos.id = :id AND %s
+		`, photoAttrs, visibleSetSQL)},
+		{&getPhotoByHashStmt, fmt.Sprintf(`
+		SELECT %s FROM photos
+		JOIN sets ON photos.set_id = sets.id
+		LEFT JOIN focal_points ON focal_points.content_hash = photos.content_hash
+		WHERE photos.content_hash = :hash AND %s
+		LIMIT 1
+		`, photoAttrs, visibleSetSQL)},
+		{&getSharedPhotoStmt, fmt.Sprintf(`
+		SELECT %s FROM photos
+		JOIN sets ON photos.set_id = sets.id
+		LEFT JOIN focal_points ON focal_points.content_hash = photos.content_hash
+		WHERE (photos.id = :id OR photos.content_hash = :hash)
+		AND (photos.id = :photo_id OR photos.set_id = :set_id AND photos.hidden = 0)
+		LIMIT 1
+		`, photoAttrs)},
+		{&getPhotosStmt, fmt.Sprintf(`
+		SELECT %s FROM photos
+		JOIN sets ON photos.set_id = sets.id
+		LEFT JOIN focal_points ON focal_points.content_hash = photos.content_hash
+		WHERE set_id = :id AND photos.hidden = 0 AND %s
+		ORDER BY photos.taken_at ASC
+		`, photoAttrs, visibleSetSQL)},
+		{&getUserByNameStmt, `
+		SELECT id, name, admin, password_hash FROM users WHERE name = ?
+		`},
+		{&getSessionUserStmt, `
+		SELECT users.id, users.name, users.admin, sessions.csrf_token FROM sessions
+		JOIN users ON sessions.user_id = users.id
+		WHERE token_hash = ? AND expires_at > datetime('now')
+		`},
+		{&getTokenUserStmt, `
+		SELECT users.id, users.name, users.admin FROM api_tokens
+		JOIN users ON api_tokens.user_id = users.id
+		WHERE token_hash = ?
+		`},
+		{&touchTokenStmt, `
+		UPDATE api_tokens SET last_used_at = datetime('now') WHERE token_hash = ?
+		`},
+		{&insertSessionStmt, `
+		INSERT INTO sessions (user_id, token_hash, csrf_token, expires_at)
+		VALUES (?, ?, ?, ?)
+		`},
+		{&deleteSessionStmt, `
+		DELETE FROM sessions WHERE token_hash = ?
+		`},
+		{&deleteExpiredSessionsStmt, `
+		DELETE FROM sessions WHERE expires_at <= datetime('now')
+		`},
+	}
 
-	getSetStmt, err = db.Prepare(fmt.Sprintf(`
-	SELECT %s FROM sets
-	JOIN photos ON sets.thumb_photo_id = photos.id
-	WHERE sets.id = ?
-	`, setAttrs))
-	if err != nil {
-		log.Fatal(err)
+	stmts := make([]*sql.Stmt, len(queries))
+	for i, q := range queries {
+		stmts[i], err = newDb.Prepare(q.query)
+		if err != nil {
+			newDb.Close() // also releases statements prepared so far
+			return err
+		}
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	closeDatabase()
+
+	db = newDb
+	thumbGen.Store(&thumbs.Generator{
+		Dir:         thumbsPath,
+		Thumbnailer: thumbnailer,
+		Profiles:    cfg.ThumbProfiles,
+		DB:          newDb,
+		Watermark:   cfg.Watermark,
+	})
+	preparedStmts = stmts
+	for i, q := range queries {
+		*q.stmt = stmts[i]
+	}
+
+	return nil
+}
+
+// must be called with dbMutex held for writing
+func closeDatabase() {
+	if db == nil {
+		return
+	}
+
+	for _, stmt := range preparedStmts {
+		stmt.Close()
 	}
+	db.Close() // waits for running queries to finish
+
+	db = nil
+	preparedStmts = nil
+}
 
-	getSetsStmt, err = db.Prepare(fmt.Sprintf(`
-	SELECT %s FROM sets
-	JOIN photos ON sets.thumb_photo_id = photos.id
-	ORDER BY sets.taken_at DESC
-	`, setAttrs))
+// staticDir serves the files of the public directory but for thumbs, which
+// are served by getThumbHandler to visible photos only, and lists no
+// directories
+type staticDir string
+
+func (d staticDir) Open(name string) (http.File, error) { // implements FileSystem
+	if name == "/thumbs" || strings.HasPrefix(name, "/thumbs/") {
+		return nil, os.ErrNotExist
+	}
+
+	f, err := http.Dir(d).Open(name)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	photoAttrs := `aperture, camera, exposure_comp, exposure_time, flash,
-	focal_length, focal_length_35, height, id, iso, lat, lens, lng,
-	next_photo_id, path, prev_photo_id, set_id, size, taken_at, width`
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		index, err := http.Dir(d).Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
 
-	getPhotoStmt, err = db.Prepare(fmt.Sprintf(`
-	SELECT %s FROM photos WHERE id = ?
-	`, photoAttrs))
+	return f, nil
+}
+
+func Run(thymePath string, opts Options) {
+	cfg, err := config.Load()
 	if err != nil {
 		log.Fatal(err)
 	}
+	currentConfig.Store(cfg)
+	opts = opts.withConfig(cfg)
 
-	getPhotosStmt, err = db.Prepare(fmt.Sprintf(`
-	SELECT %s FROM photos WHERE set_id = ? ORDER BY taken_at ASC
-	`, photoAttrs))
+	ln, err := listen(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
-}
+	addrURL := listenURL(ln, opts)
 
-func Run(thymePath string) {
-	setupDatabase()
-	defer db.Close()
-	defer getSetStmt.Close()
-	defer getSetsStmt.Close()
-	defer getPhotoStmt.Close()
-	defer getPhotosStmt.Close()
+	var cr *certReloader
+	if opts.TLSCertPath != "" || opts.TLSKeyPath != "" {
+		cr, err = newCertReloader(opts.TLSCertPath, opts.TLSKeyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ln = tls.NewListener(ln, &tls.Config{GetCertificate: cr.GetCertificate})
+	}
 
 	rootPath := path.Join(thymePath, "public")
-	http.Handle("/", http.FileServer(http.Dir(rootPath))) // static
-	http.HandleFunc("/set", getSetHandler)
-	http.HandleFunc("/sets", getSetsHandler)
-	http.HandleFunc("/photo", getPhotoHandler)
-	http.HandleFunc("/photos", getPhotosHandler)
+	// absolute, as vipsthumbnail resolves relative output paths against the
+	// directory of the photo
+	thumbsPath, err = filepath.Abs(path.Join(rootPath, "thumbs"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(thumbsPath, os.ModeDir|0755); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := setupDatabase(cfg); err != nil {
+		log.Fatal(err)
+	}
+	thumbsSlots = make(chan struct{}, cfg.ThumbConcurrency)
+	http.Handle("/", http.FileServer(staticDir(rootPath))) // static
+	http.HandleFunc("/thumbs/", http.NotFound)             // but for the patterns below
+	http.Handle("GET /thumbs/{name}", requireAuth(http.HandlerFunc(redirectThumbHandler)))
+	http.Handle("GET /thumbs/{shard}/{name}", requireAuth(http.HandlerFunc(getThumbHandler)))
+	http.Handle("GET /thumbnails/failures", requireAdmin(http.HandlerFunc(getThumbFailuresHandler)))
+	http.Handle("GET /duplicates", requireAdmin(http.HandlerFunc(getDuplicatesHandler)))
+	http.Handle("/set", requireAuth(http.HandlerFunc(getSetHandler)))
+	http.Handle("/sets", requireAuth(http.HandlerFunc(getSetsHandler)))
+	http.Handle("/photo", requireAuth(http.HandlerFunc(getPhotoHandler)))
+	http.Handle("/photos", requireAuth(http.HandlerFunc(getPhotosHandler)))
+	http.Handle("GET /sets/{id}/grants", requireAdmin(http.HandlerFunc(getSetGrantsHandler)))
+	http.Handle("POST /sets/{id}/grants", requireAdmin(http.HandlerFunc(createSetGrantHandler)))
+	http.Handle("DELETE /sets/{id}/grants/{grant_id}", requireAdmin(http.HandlerFunc(deleteSetGrantHandler)))
+	http.Handle("PATCH /sets/{id}", requireAdmin(http.HandlerFunc(updateSetAccessHandler)))
+	http.Handle("POST /sets/{id}/share", requireAuth(http.HandlerFunc(createSetShareHandler)))
+	http.Handle("POST /photos/{id}/share", requireAuth(http.HandlerFunc(createPhotoShareHandler)))
+	http.Handle("GET /shares", requireAuth(http.HandlerFunc(getSharesHandler)))
+	http.Handle("DELETE /shares/{id}", requireAuth(http.HandlerFunc(revokeShareHandler)))
+	http.Handle("GET /shares/{id}/accesses", requireAuth(http.HandlerFunc(getShareAccessesHandler)))
+	http.HandleFunc("GET /s/{token}", getSharedHandler)
+	http.HandleFunc("GET /s/{token}/thumbs/{name}", redirectThumbHandler)
+	http.HandleFunc("GET /s/{token}/thumbs/{shard}/{name}", getSharedThumbHandler)
+	http.Handle("GET /photos/{id}/original", requireAuth(http.HandlerFunc(getPhotoOriginalHandler)))
+	http.Handle("GET /photos/{id}/image", requireAuth(http.HandlerFunc(getPhotoImageHandler)))
+	http.Handle("PUT /photos/{id}/focus", requireAdmin(http.HandlerFunc(updatePhotoFocusHandler)))
+	http.Handle("DELETE /photos/{id}/focus", requireAdmin(http.HandlerFunc(updatePhotoFocusHandler)))
+	http.HandleFunc("GET /s/{token}/photos/{id}/image", getSharedImageHandler)
+	http.HandleFunc("GET /s/{token}/photos/{id}/original", getSharedOriginalHandler)
+	http.Handle("GET /sets/{id}/download", requireAuth(http.HandlerFunc(downloadSetHandler)))
+	http.Handle("POST /sets/{id}/download", requireAuth(http.HandlerFunc(downloadSetHandler)))
+	http.HandleFunc("GET /s/{token}/download", downloadSharedHandler)
+	http.HandleFunc("POST /s/{token}/download", downloadSharedHandler)
+	http.HandleFunc("POST /login", loginHandler)
+	http.Handle("POST /logout", requireAuth(http.HandlerFunc(logoutHandler)))
+	http.Handle("GET /session", requireAuth(http.HandlerFunc(getSessionHandler)))
+
+	srv := &http.Server{
+		Handler: handlers.LoggingHandler(os.Stdout, http.DefaultServeMux),
+	}
+
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 
-	fmt.Printf("Listening on http://%s serving path %q\n", listenAddr, rootPath)
+	fmt.Printf("Listening on %s serving path %q\n", addrURL, rootPath)
 	fmt.Println("Press Ctrl-C to exit")
 
-	log.Fatal(http.ListenAndServe(listenAddr, handlers.LoggingHandler(os.Stdout, http.DefaultServeMux)))
+	handleSignals(opts, cr)
+	shutdown(srv)
 }
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/agorf/thyme-backend/config"
+)
+
+// setupTestDatabase points the server at a fresh database, configured with
+// the given JSON settings, which is closed when the test ends
+func setupTestDatabase(t *testing.T, settings string) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "thyme.json")
+	if err := os.WriteFile(configPath, []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("THYME_CONFIG", configPath)
+	t.Setenv("HOME", dir) // where the database is by default
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentConfig.Store(cfg)
+	thumbsPath = filepath.Join(dir, "thumbs")
+
+	if err := setupDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dbMutex.Lock()
+		defer dbMutex.Unlock()
+		closeDatabase()
+	})
+}
+
+// mustExec runs statements that set up a test, failing it on error
+func mustExec(t *testing.T, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,579 @@
+package server
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/agorf/thyme-backend/thumb"
+	"github.com/agorf/thyme-backend/users"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const shareAttrs = `shares.id, shares.token, shares.set_id, shares.photo_id,
+users.name, shares.password_hash, shares.allow_download, shares.expires_at,
+shares.revoked_at, shares.created_at,
+(SELECT COUNT(*) FROM share_accesses WHERE share_id = shares.id),
+(SELECT MAX(accessed_at) FROM share_accesses WHERE share_id = shares.id)`
+
+const sharesFromSQL = `FROM shares LEFT JOIN users ON shares.created_by = users.id`
+
+// restricts shares to those created by :user_id, unless :unrestricted is true
+const ownShareSQL = `(:unrestricted OR shares.created_by = :user_id)`
+
+type Share struct {
+	Id             int
+	Token          string
+	SetId          sql.NullInt64
+	PhotoId        sql.NullInt64
+	CreatedBy      sql.NullString
+	PasswordHash   sql.NullString
+	AllowDownload  bool
+	ExpiresAt      sql.NullString
+	RevokedAt      sql.NullString
+	CreatedAt      string
+	AccessCount    int
+	LastAccessedAt sql.NullString
+}
+
+func (s *Share) URL() string {
+	return path.Join("", "s", s.Token)
+}
+
+func (s *Share) MarshalJSON() ([]byte, error) { // implements Marshaler
+	shareMap := map[string]interface{}{
+		"access_count":   s.AccessCount,
+		"allow_download": s.AllowDownload,
+		"created_at":     s.CreatedAt,
+		"id":             s.Id,
+		"password":       s.PasswordHash.Valid,
+		"token":          s.Token,
+		"url":            s.URL(),
+	}
+	shareMap["created_by"], _ = s.CreatedBy.Value()
+	shareMap["expires_at"], _ = s.ExpiresAt.Value()
+	shareMap["last_accessed_at"], _ = s.LastAccessedAt.Value()
+	shareMap["photo_id"], _ = s.PhotoId.Value()
+	shareMap["revoked_at"], _ = s.RevokedAt.Value()
+	shareMap["set_id"], _ = s.SetId.Value()
+	return json.Marshal(shareMap)
+}
+
+// cookieName and cookieValue identify a visitor who has already given the
+// password of a share, so that it is not checked for every thumb
+func (s *Share) cookieName() string {
+	return fmt.Sprintf("thyme_share_%d", s.Id)
+}
+
+func (s *Share) cookieValue() string {
+	return users.HashToken(s.Token + s.PasswordHash.String)
+}
+
+func scanShare(row rowScanner, share *Share) error {
+	return row.Scan(
+		&share.Id,
+		&share.Token,
+		&share.SetId,
+		&share.PhotoId,
+		&share.CreatedBy,
+		&share.PasswordHash,
+		&share.AllowDownload,
+		&share.ExpiresAt,
+		&share.RevokedAt,
+		&share.CreatedAt,
+		&share.AccessCount,
+		&share.LastAccessedAt,
+	)
+}
+
+func getShareById(shareId int, user *User) (share *Share, err error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	share = &Share{}
+	row := db.QueryRow(fmt.Sprintf(`
+	SELECT %s %s WHERE shares.id = :id AND %s
+	`, shareAttrs, sharesFromSQL, ownShareSQL), append(visibilityArgs(user), sql.Named("id", shareId))...)
+	err = scanShare(row, share)
+	return
+}
+
+// getActiveShare returns the share with the token unless it has expired or
+// has been revoked
+func getActiveShare(token string) (share *Share, err error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	share = &Share{}
+	row := db.QueryRow(fmt.Sprintf(`
+	SELECT %s %s
+	WHERE shares.token = ? AND shares.revoked_at IS NULL
+	AND (shares.expires_at IS NULL OR shares.expires_at > datetime('now'))
+	`, shareAttrs, sharesFromSQL), token)
+	err = scanShare(row, share)
+	return
+}
+
+// creatorCanSee reports whether the creator of a share can still see what it
+// shares. Everyone can while authentication is disabled, when shares are
+// created without a creator.
+func creatorCanSee(share *Share) (bool, error) {
+	if !currentConfig.Load().Auth {
+		return true, nil
+	}
+
+	creator := &User{}
+	dbMutex.RLock()
+	err := db.QueryRow(`
+	SELECT users.id, users.name, users.admin FROM shares
+	JOIN users ON shares.created_by = users.id
+	WHERE shares.id = ?
+	`, share.Id).Scan(&creator.Id, &creator.Name, &creator.Admin)
+	dbMutex.RUnlock()
+
+	if err == sql.ErrNoRows { // no creator
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if share.SetId.Valid {
+		_, err = getSetById(int(share.SetId.Int64), creator)
+	} else {
+		_, err = getPhotoById(int(share.PhotoId.Int64), creator)
+	}
+	if err == sql.ErrNoRows { // not visible or deleted
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func getShares(user *User) (shares []*Share, err error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	rows, err := db.Query(fmt.Sprintf(`
+	SELECT %s %s WHERE %s ORDER BY shares.created_at DESC
+	`, shareAttrs, sharesFromSQL, ownShareSQL), visibilityArgs(user)...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	shares = []*Share{}
+	for rows.Next() {
+		share := Share{}
+		if err = scanShare(rows, &share); err != nil {
+			return
+		}
+		shares = append(shares, &share)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// sharePhotos returns the photos a share gives access to
+func sharePhotos(share *Share) ([]*Photo, error) {
+	if share.SetId.Valid {
+		photos, err := getPhotosBySetId(int(share.SetId.Int64), nil) // nil bypasses access control
+		for _, photo := range photos {
+			photo.shared = true
+		}
+		return photos, err
+	}
+
+	photo, err := getPhotoById(int(share.PhotoId.Int64), nil)
+	if err != nil {
+		return nil, err
+	}
+	photo.NextPhotoId.Valid = false // siblings are not shared
+	photo.PrevPhotoId.Valid = false
+	photo.shared = true
+	return []*Photo{photo}, nil
+}
+
+// getSharedPhoto returns the photo of a share with an id, or with a content
+// hash if photoId is 0
+func getSharedPhoto(share *Share, photoId int, contentHash string) (*Photo, error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	photo := &Photo{}
+	row := getSharedPhotoStmt.QueryRow(
+		sql.Named("id", photoId),
+		sql.Named("hash", contentHash),
+		sql.Named("photo_id", share.PhotoId),
+		sql.Named("set_id", share.SetId),
+	)
+	if err := scanPhoto(row, photo); err != nil {
+		return nil, err
+	}
+
+	if share.PhotoId.Valid { // siblings are not shared
+		photo.NextPhotoId.Valid = false
+		photo.PrevPhotoId.Valid = false
+	}
+	photo.shared = true
+	return photo, nil
+}
+
+func logShareAccess(share *Share, r *http.Request) error {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	_, err := db.Exec(`
+	INSERT INTO share_accesses (share_id, accessed_at, remote_addr, path)
+	VALUES (?, datetime('now'), ?, ?)
+	`, share.Id, r.RemoteAddr, r.URL.Path)
+	return err
+}
+
+// findSharedPhoto returns the photo of a share with an id, or with a content
+// hash if photoId is 0, and logs the access, responding with 404 if there is
+// no such photo
+func findSharedPhoto(share *Share, photoId int, contentHash string, w http.ResponseWriter, r *http.Request) (*Photo, bool) {
+	photo, err := getSharedPhoto(share, photoId, contentHash)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return nil, false
+	}
+
+	if err := logShareAccess(share, r); err != nil {
+		internalServerError(w, r, err)
+		return nil, false
+	}
+
+	return photo, true
+}
+
+// authorizeShare looks up the share in the request path and checks its
+// password, given as the HTTP basic authentication password, responding with
+// 404 or 401 on failure. Shares whose creator lost access are not found.
+func authorizeShare(w http.ResponseWriter, r *http.Request) (*Share, bool) {
+	share, err := getActiveShare(r.PathValue("token"))
+	if err == sql.ErrNoRows { // share does not exist, has expired or has been revoked
+		http.NotFound(w, r)
+		return nil, false
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return nil, false
+	}
+
+	if ok, err := creatorCanSee(share); err != nil {
+		internalServerError(w, r, err)
+		return nil, false
+	} else if !ok {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	if !share.PasswordHash.Valid {
+		return share, true
+	}
+
+	if cookie, err := r.Cookie(share.cookieName()); err == nil &&
+		subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(share.cookieValue())) == 1 {
+		return share, true
+	}
+
+	_, password, ok := r.BasicAuth()
+	if ok && bcrypt.CompareHashAndPassword([]byte(share.PasswordHash.String), []byte(password)) == nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:     share.cookieName(),
+			Value:    share.cookieValue(),
+			Path:     "/" + share.URL(),
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return share, true
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="thyme shared photos"`)
+	unauthorized(w, r)
+	return nil, false
+}
+
+// createShare creates a share for a set or a photo from the "password",
+// "download" and "expires_in" (e.g. "72h") form values
+func createShare(setId, photoId sql.NullInt64, w http.ResponseWriter, r *http.Request) {
+	var createdBy sql.NullInt64
+	var expiresAt, passwordHash sql.NullString
+	var allowDownload bool
+
+	if user := currentUser(r); user != nil {
+		createdBy = sql.NullInt64{Int64: int64(user.Id), Valid: true}
+	}
+
+	if download := r.FormValue("download"); download != "" {
+		var err error
+		if allowDownload, err = strconv.ParseBool(download); err != nil {
+			badRequest(w, r)
+			return
+		}
+	}
+
+	if expiresIn := r.FormValue("expires_in"); expiresIn != "" {
+		d, err := time.ParseDuration(expiresIn)
+		if err != nil || d <= 0 {
+			badRequest(w, r)
+			return
+		}
+		expiresAt.String = time.Now().Add(d).UTC().Format("2006-01-02 15:04:05")
+		expiresAt.Valid = true
+	}
+
+	if password := r.FormValue("password"); password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		passwordHash = sql.NullString{String: string(hash), Valid: true}
+	}
+
+	token, err := users.GenerateToken()
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	dbMutex.RLock()
+	result, err := db.Exec(`
+	INSERT INTO shares (
+	token, set_id, photo_id, created_by, password_hash, allow_download,
+	expires_at, created_at
+	)
+	VALUES (?, ?, ?, ?, ?, ?, ?, datetime('now'))
+	`, token, setId, photoId, createdBy, passwordHash, allowDownload, expiresAt)
+	dbMutex.RUnlock()
+
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	shareId, err := result.LastInsertId()
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	share, err := getShareById(int(shareId), nil)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(share)
+}
+
+func createSetShareHandler(w http.ResponseWriter, r *http.Request) {
+	setId, ok := pathId("id", w, r)
+	if !ok {
+		return
+	}
+
+	_, err := getSetById(setId, currentUser(r))
+	if err == sql.ErrNoRows { // set does not exist or is not visible
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	createShare(sql.NullInt64{Int64: int64(setId), Valid: true}, sql.NullInt64{}, w, r)
+}
+
+func createPhotoShareHandler(w http.ResponseWriter, r *http.Request) {
+	photoId, ok := pathId("id", w, r)
+	if !ok {
+		return
+	}
+
+	_, err := getPhotoById(photoId, currentUser(r))
+	if err == sql.ErrNoRows { // photo does not exist or is not visible
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	createShare(sql.NullInt64{}, sql.NullInt64{Int64: int64(photoId), Valid: true}, w, r)
+}
+
+func getSharesHandler(w http.ResponseWriter, r *http.Request) {
+	shares, err := getShares(currentUser(r))
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shares)
+}
+
+func revokeShareHandler(w http.ResponseWriter, r *http.Request) {
+	shareId, ok := pathId("id", w, r)
+	if !ok {
+		return
+	}
+
+	dbMutex.RLock()
+	result, err := db.Exec(fmt.Sprintf(`
+	UPDATE shares SET revoked_at = datetime('now')
+	WHERE id = :id AND revoked_at IS NULL AND %s
+	`, ownShareSQL), append(visibilityArgs(currentUser(r)), sql.Named("id", shareId))...)
+	dbMutex.RUnlock()
+
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 { // share does not exist or is revoked
+		http.NotFound(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getShareAccessesHandler(w http.ResponseWriter, r *http.Request) {
+	shareId, ok := pathId("id", w, r)
+	if !ok {
+		return
+	}
+
+	_, err := getShareById(shareId, currentUser(r))
+	if err == sql.ErrNoRows { // share does not exist or belongs to someone else
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	rows, err := db.Query(`
+	SELECT accessed_at, remote_addr, path FROM share_accesses
+	WHERE share_id = ? ORDER BY id DESC
+	`, shareId)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	accesses := []map[string]interface{}{}
+	for rows.Next() {
+		var accessedAt, remoteAddr, urlPath string
+		if err := rows.Scan(&accessedAt, &remoteAddr, &urlPath); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		accesses = append(accesses, map[string]interface{}{
+			"accessed_at": accessedAt,
+			"path":        urlPath,
+			"remote_addr": remoteAddr,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accesses)
+}
+
+// getSharedHandler serves the set or photo of a share to anyone with the link
+func getSharedHandler(w http.ResponseWriter, r *http.Request) {
+	share, ok := authorizeShare(w, r)
+	if !ok {
+		return
+	}
+
+	photos, err := sharePhotos(share)
+	if err != nil && err != sql.ErrNoRows {
+		internalServerError(w, r, err)
+		return
+	}
+
+	if err := logShareAccess(share, r); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	redactPhotos(photos, true)
+
+	for _, photo := range photos {
+		photo.baseURL = share.URL()
+	}
+
+	sharedMap := map[string]interface{}{
+		"allow_download": share.AllowDownload,
+		"photos":         photos,
+	}
+	sharedMap["expires_at"], _ = share.ExpiresAt.Value()
+
+	if share.SetId.Valid {
+		set, err := getSetById(int(share.SetId.Int64), nil)
+		if err == sql.ErrNoRows { // set was deleted
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		set.baseURL = share.URL()
+		set.shared = true
+		sharedMap["set"] = set
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sharedMap)
+}
+
+// getSharedThumbHandler serves thumbs of the photos in a share only
+func getSharedThumbHandler(w http.ResponseWriter, r *http.Request) {
+	share, ok := authorizeShare(w, r)
+	if !ok {
+		return
+	}
+
+	contentHash, profile, ok := thumb.ParseBasename(r.PathValue("name"))
+	if !ok || !isThumbProfile(profile) {
+		http.NotFound(w, r)
+		return
+	}
+
+	photo, ok := findSharedPhoto(share, 0, contentHash, w, r)
+	if !ok {
+		return
+	}
+
+	serveThumb(photo, profile, w, r)
+}
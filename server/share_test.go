@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// getShared requests a share link the way a visitor would
+func getShared(token string, prepare func(r *http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/s/"+token, nil)
+	r.SetPathValue("token", token)
+	if prepare != nil {
+		prepare(r)
+	}
+	w := httptest.NewRecorder()
+	getSharedHandler(w, r)
+	return w
+}
+
+func TestSharedLinks(t *testing.T) {
+	setupTestDatabase(t, `{"auth": true}`)
+	setupTestSets(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, `
+	INSERT INTO shares (token, set_id, photo_id, created_by, password_hash, expires_at, revoked_at, created_at) VALUES
+	('open', 2, NULL, 2, NULL, NULL, NULL, datetime('now')),
+	('later', 2, NULL, 2, NULL, datetime('now', '+1 hour'), NULL, datetime('now')),
+	('expired', 2, NULL, 2, NULL, datetime('now', '-1 minute'), NULL, datetime('now')),
+	('revoked', 2, NULL, 2, NULL, NULL, datetime('now'), datetime('now')),
+	('secret', 2, NULL, 2, ?, NULL, NULL, datetime('now')),
+	('photo', NULL, 2, 2, NULL, NULL, NULL, datetime('now')),
+	('lost-set', 5, NULL, 2, NULL, NULL, NULL, datetime('now')),
+	('lost-photo', NULL, 5, 2, NULL, NULL, NULL, datetime('now')),
+	('admin', 5, NULL, 1, NULL, NULL, NULL, datetime('now')),
+	('no-creator', 5, NULL, NULL, NULL, NULL, NULL, datetime('now'))
+	`, string(hash))
+
+	tests := []struct {
+		token   string
+		prepare func(r *http.Request)
+		code    int
+	}{
+		{"open", nil, http.StatusOK},
+		{"later", nil, http.StatusOK},
+		{"expired", nil, http.StatusNotFound},
+		{"revoked", nil, http.StatusNotFound},
+		{"unknown", nil, http.StatusNotFound},
+		{"secret", nil, http.StatusUnauthorized},
+		{"secret", func(r *http.Request) { r.SetBasicAuth("", "wrong") }, http.StatusUnauthorized},
+		{"secret", func(r *http.Request) { r.SetBasicAuth("", "pw") }, http.StatusOK},
+		{"photo", nil, http.StatusOK},
+		// alice cannot see set 5, so her links to it stop working
+		{"lost-set", nil, http.StatusNotFound},
+		{"lost-photo", nil, http.StatusNotFound},
+		{"admin", nil, http.StatusOK},
+		{"no-creator", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := getShared(tt.token, tt.prepare); w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.token, w.Code, tt.code)
+		}
+	}
+
+	// the password is remembered in a cookie
+	w := getShared("secret", func(r *http.Request) { r.SetBasicAuth("", "pw") })
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got cookies %v", cookies)
+	}
+	if w := getShared("secret", func(r *http.Request) { r.AddCookie(cookies[0]) }); w.Code != http.StatusOK {
+		t.Errorf("secret with cookie: got %d", w.Code)
+	}
+
+	// links work again once their creator can see what they share
+	mustExec(t, `INSERT INTO set_grants (set_id, user_id) VALUES (5, 2)`)
+	if w := getShared("lost-set", nil); w.Code != http.StatusOK {
+		t.Errorf("lost set after grant: got %d", w.Code)
+	}
+
+	// deleted sets are not found
+	mustExec(t, `DELETE FROM photos WHERE set_id = 5`)
+	mustExec(t, `DELETE FROM sets WHERE id = 5`)
+	for _, token := range []string{"lost-set", "no-creator"} {
+		if w := getShared(token, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s of a deleted set: got %d", token, w.Code)
+		}
+	}
+
+	var accesses int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM share_accesses`).Scan(&accesses); err != nil {
+		t.Fatal(err)
+	}
+	if accesses == 0 {
+		t.Error("no accesses were logged")
+	}
+}
+
+func TestRevokeShare(t *testing.T) {
+	setupTestDatabase(t, `{"auth": true}`)
+	setupTestSets(t)
+
+	mustExec(t, `
+	INSERT INTO shares (id, token, set_id, created_by, created_at) VALUES
+	(1, 'alice', 2, 2, datetime('now')), (2, 'bob', 1, 3, datetime('now'))
+	`)
+
+	tests := []struct {
+		name    string
+		user    *User
+		shareId int
+		code    int
+	}{
+		{"someone else's", &User{Id: 2, Name: "alice"}, 2, http.StatusNotFound},
+		{"own", &User{Id: 2, Name: "alice"}, 1, http.StatusNoContent},
+		{"already revoked", &User{Id: 2, Name: "alice"}, 1, http.StatusNotFound},
+		{"by an administrator", &User{Id: 1, Name: "boss", Admin: true}, 2, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("DELETE", "/shares/"+strconv.Itoa(tt.shareId), nil)
+		r.SetPathValue("id", strconv.Itoa(tt.shareId))
+		r = r.WithContext(context.WithValue(r.Context(), userContextKey, tt.user))
+		w := httptest.NewRecorder()
+		revokeShareHandler(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.code)
+		}
+	}
+
+	for _, token := range []string{"alice", "bob"} {
+		if w := getShared(token, nil); w.Code != http.StatusNotFound {
+			t.Errorf("revoked %s: got %d", token, w.Code)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/agorf/thyme-backend/config"
+)
+
+// reload re-reads the configuration and reopens the database. Listener
+// settings other than the TLS certificate require a restart.
+func reload(flagOpts Options, cr *certReloader) {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Print("reload failed: ", err)
+		return
+	}
+
+	if err := setupDatabase(cfg); err != nil {
+		log.Print("reload failed: ", err)
+		return
+	}
+
+	oldOpts := flagOpts.withConfig(currentConfig.Load())
+	newOpts := flagOpts.withConfig(cfg)
+	currentConfig.Store(cfg)
+
+	if newOpts.ListenAddr != oldOpts.ListenAddr || newOpts.SocketPath != oldOpts.SocketPath {
+		log.Print("listen address changed, restart to apply")
+	}
+
+	if cr != nil {
+		cr.setPaths(newOpts.TLSCertPath, newOpts.TLSKeyPath)
+	} else if newOpts.TLSCertPath != "" {
+		log.Print("TLS enabled, restart to apply")
+	}
+
+	log.Print("reloaded configuration and database")
+}
+
+// handleSignals reloads on SIGHUP and returns on SIGINT or SIGTERM
+func handleSignals(flagOpts Options, cr *certReloader) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			log.Printf("received %s, shutting down", sig)
+			return
+		}
+		reload(flagOpts, cr)
+	}
+}
+
+// shutdown waits for in-flight requests to finish, up to the configured
+// timeout, and closes the database
+func shutdown(srv *http.Server) {
+	timeout := time.Duration(currentConfig.Load().ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Print("forcing shutdown: ", err)
+		srv.Close()
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	closeDatabase()
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/agorf/thyme-backend/config"
+	"github.com/agorf/thyme-backend/thumb"
+	"github.com/agorf/thyme-backend/thumbs"
+	"golang.org/x/sync/singleflight"
+)
+
+// thumb variants from the smallest to the largest
+var thumbFormatPreference = []string{"avif", "webp"}
+
+var (
+	thumbGen    atomic.Pointer[thumbs.Generator]
+	thumbGroup  singleflight.Group // coalesces requests for the same thumb
+	thumbsSlots chan struct{}      // limits concurrent thumb generation
+)
+
+func isThumbProfile(name string) bool {
+	_, ok := thumbGen.Load().Profiles[name]
+	return ok
+}
+
+// errNotHashed is returned for photos scanned before content hashes were
+// kept, which thumbs cannot be named for
+var errNotHashed = errors.New("photo has no content hash, run thyme scan or thyme thumbs")
+
+func (p *Photo) focus() *thumb.Focus {
+	return focus(p.FocalX, p.FocalY)
+}
+
+// thumbsPhoto returns what the thumbs package needs to know about a photo
+func (p *Photo) thumbsPhoto() thumbs.Photo {
+	return thumbs.Photo{
+		Path:      p.Path,
+		Hash:      p.ContentHash.String,
+		Focus:     p.focus(),
+		Watermark: watermarked(p.shared),
+	}
+}
+
+// generateOnce runs generate unless a call with the same key is already
+// running, in which case it waits for that call's result instead. At most
+// thumb_concurrency calls run at the same time and each is given up after
+// thumb_timeout. Callers share the call, so it is not tied to any request.
+func generateOnce(key string, generate func(ctx context.Context) (string, error)) (string, error) {
+	result, err, _ := thumbGroup.Do(key, func() (interface{}, error) {
+		thumbsSlots <- struct{}{}
+		defer func() { <-thumbsSlots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(),
+			time.Duration(currentConfig.Load().ThumbTimeout)*time.Second)
+		defer cancel()
+
+		return generate(ctx)
+	})
+
+	if err != nil {
+		return "", err
+	}
+	return result.(string), nil
+}
+
+// ensureThumb returns the path of a photo thumb in a format, where "" stands
+// for the profile format, generating it first if it is missing or outdated.
+// The database is only held while preparing and recording the thumb, not
+// while rendering it, so that reloads do not wait for renders.
+func ensureThumb(photo *Photo, profile, format string) (string, error) {
+	if !photo.ContentHash.Valid {
+		return "", errNotHashed
+	}
+
+	dbMutex.RLock()
+	g := thumbGen.Load()
+	job, err := g.ThumbJob(photo.thumbsPhoto(), profile, format)
+	dbMutex.RUnlock()
+
+	if err != nil {
+		return "", err
+	}
+	if job.Current() {
+		return job.Path, nil
+	}
+
+	return generateOnce(job.Path, func(ctx context.Context) (string, error) {
+		err := g.Render(ctx, job)
+
+		dbMutex.RLock()
+		defer dbMutex.RUnlock()
+
+		g := thumbGen.Load() // the database may have been reloaded
+		if err == nil {
+			err = g.Record(job)
+		}
+		if statusErr := g.RecordThumbStatus(photo.thumbsPhoto(), err); statusErr != nil {
+			log.Print(statusErr)
+		}
+		return job.Path, err
+	})
+}
+
+// accepts reports whether the Accept header of a request names a media type
+// explicitly. Wildcards do not count, since they are sent by browsers that
+// cannot decode newer formats too.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, item := range strings.Split(accept, ",") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+			if err != nil || mt != mediaType {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateFormat picks the thumb format of a profile to serve, preferring
+// the smallest variants the client accepts. It returns "" for the profile
+// format.
+func negotiateFormat(profile string, w http.ResponseWriter, r *http.Request) string {
+	variants := thumbGen.Load().Variants(profile)
+	if len(variants) == 0 {
+		return ""
+	}
+
+	w.Header().Add("Vary", "Accept")
+
+	for _, format := range thumbFormatPreference {
+		if slices.Contains(variants, format) &&
+			accepts(r, mime.TypeByExtension(config.FormatExt(format))) {
+			return format
+		}
+	}
+	return ""
+}
+
+// serveThumb serves the thumb of a photo named in the request path, in the
+// best format the client accepts. Names with an outdated profile version or
+// in the wrong shard are not found.
+func serveThumb(photo *Photo, profile string, w http.ResponseWriter, r *http.Request) {
+	requested := path.Join(r.PathValue("shard"), r.PathValue("name"))
+	basename, _ := thumbGen.Load().Basename(photo.thumbsPhoto(), profile, "")
+	if requested != thumb.Path(basename) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if format := negotiateFormat(profile, w, r); format != "" {
+		thumbPath, err := ensureThumb(photo, profile, format)
+		if err == nil {
+			http.ServeFile(w, r, thumbPath)
+			return
+		}
+		log.Print(err) // fall back to the profile format
+	}
+
+	thumbPath, err := ensureThumb(photo, profile, "")
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	http.ServeFile(w, r, thumbPath)
+}
+
+// redirectThumbHandler redirects requests for thumbs in the flat layout used
+// before thumbs were sharded
+func redirectThumbHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, _, ok := thumb.ParseBasename(name); !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.Redirect(w, r, thumb.Path(name), http.StatusMovedPermanently)
+}
+
+// getThumbHandler serves thumbs of visible photos, generating missing ones
+func getThumbHandler(w http.ResponseWriter, r *http.Request) {
+	contentHash, profile, ok := thumb.ParseBasename(r.PathValue("name"))
+	if !ok || !isThumbProfile(profile) {
+		http.NotFound(w, r)
+		return
+	}
+
+	photo, err := getPhotoByHash(contentHash, currentUser(r))
+	if err == sql.ErrNoRows { // no such photo or none is visible
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	serveThumb(photo, profile, w, r)
+}
+
+// getThumbFailuresHandler lists the photos whose thumbs could not be
+// generated, most recent first, to help find corrupt originals
+func getThumbFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig.Load()
+
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	rows, err := db.Query(`
+	SELECT photos.id, photos.set_id, photos.path, thumb_status.error,
+	thumb_status.attempts, thumb_status.last_attempt_at
+	FROM thumb_status
+	JOIN photos ON thumb_status.photo_path = photos.path
+	WHERE thumb_status.status = 'failed'
+	ORDER BY thumb_status.last_attempt_at DESC
+	`)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	failures := []map[string]interface{}{}
+	for rows.Next() {
+		var photo Photo
+		var message, lastAttemptAt string
+		var attempts int
+		err := rows.Scan(&photo.Id, &photo.SetId, &photo.Path, &message, &attempts, &lastAttemptAt)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		photo.redact(cfg, currentUser(r) == nil)
+
+		failure := map[string]interface{}{
+			"photo_id":        photo.Id,
+			"set_id":          photo.SetId,
+			"error":           message,
+			"attempts":        attempts,
+			"last_attempt_at": lastAttemptAt,
+		}
+		failure["path"], _ = photo.displayPath.Value()
+		failures = append(failures, failure)
+	}
+	if err := rows.Err(); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(failures)
+}
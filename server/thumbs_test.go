@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/agorf/thyme-backend/config"
+	"github.com/agorf/thyme-backend/thumbs"
+)
+
+func TestAccepts(t *testing.T) {
+	tests := []struct {
+		accept    []string
+		mediaType string
+		want      bool
+	}{
+		{[]string{"image/avif,image/webp,*/*"}, "image/webp", true},
+		{[]string{"image/avif, image/webp;q=0.8, */*;q=0.5"}, "image/webp", true},
+		{[]string{"text/html", "image/webp"}, "image/webp", true},
+		{[]string{"image/webp;q=0"}, "image/webp", false},
+		{[]string{"image/*,*/*"}, "image/webp", false},
+		{[]string{"image/avif"}, "image/webp", false},
+		{nil, "image/webp", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/thumbs/ab/ab12_small_0123abcd.jpg", nil)
+		for _, accept := range tt.accept {
+			r.Header.Add("Accept", accept)
+		}
+		if got := accepts(r, tt.mediaType); got != tt.want {
+			t.Errorf("accepts(%q, %q) = %v, want %v", tt.accept, tt.mediaType, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	old := thumbGen.Load()
+	t.Cleanup(func() { thumbGen.Store(old) })
+
+	profiles := map[string]config.ThumbProfile{
+		"small": {Size: 200, Format: "jpeg", Variants: []string{"webp", "avif"}},
+		"webp":  {Size: 200, Format: "jpeg", Variants: []string{"webp"}},
+		"big":   {Size: 1000, Format: "jpeg"},
+	}
+
+	tests := []struct {
+		thumbnailer string
+		profile     string
+		accept      string
+		want        string
+		vary        bool
+	}{
+		{"vips", "small", "image/avif,image/webp,*/*", "avif", true},
+		{"vips", "small", "image/webp,*/*", "webp", true},
+		{"vips", "small", "image/avif;q=0,image/webp", "webp", true},
+		{"vips", "small", "*/*", "", true},
+		{"vips", "webp", "image/avif,*/*", "", true},
+		{"vips", "big", "image/avif,image/webp", "", false},
+		{"go", "small", "image/avif,image/webp", "", false},
+	}
+	for _, tt := range tests {
+		thumbnailer, err := thumbs.NewThumbnailer(tt.thumbnailer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		thumbGen.Store(&thumbs.Generator{Thumbnailer: thumbnailer, Profiles: profiles})
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/thumbs/ab/ab12_small_0123abcd.jpg", nil)
+		r.Header.Set("Accept", tt.accept)
+
+		got := negotiateFormat(tt.profile, w, r)
+		vary := w.Header().Get("Vary") == "Accept"
+		if got != tt.want || vary != tt.vary {
+			t.Errorf("%s %s %q: got %q (Vary %v), want %q (Vary %v)", tt.thumbnailer, tt.profile,
+				tt.accept, got, vary, tt.want, tt.vary)
+		}
+	}
+}
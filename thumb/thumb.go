@@ -1,11 +1,93 @@
 package thumb
 
 import (
-	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/agorf/thyme-backend/config"
 )
 
-func Basename(photoPath, suffix string) string {
-	identifier := fmt.Sprintf("%x", md5.Sum([]byte(photoPath)))
-	return fmt.Sprintf("%s_%s.jpg", identifier, suffix)
+// HashFile returns the hex SHA-256 hash of a file. Thumbs are named after the
+// hash of their photo, so that they survive moves, are shared by copies and
+// change with the contents.
+func HashFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Focus is the point of a photo that cropped thumbs keep in view, as
+// fractions of its width and height as displayed
+type Focus struct {
+	X, Y float64
+}
+
+// Version returns the version of the thumbs of a photo rendered with a
+// profile. Cropped thumbs of photos with a focus also change with the focus
+// and watermarked thumbs with the watermark version, so that they are kept
+// apart from others.
+func Version(profile config.ThumbProfile, focus *Focus, watermark string) string {
+	if (profile.Crop == "" || focus == nil) && watermark == "" {
+		return profile.Version()
+	}
+
+	b := profile.Version()
+	if profile.Crop != "" && focus != nil {
+		b += fmt.Sprintf(" %g %g", focus.X, focus.Y)
+	}
+	if watermark != "" {
+		b += " " + watermark
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(b)))[:8]
+}
+
+// Basename returns the name of the thumb of a photo, given its content hash
+// and focus, if any, rendered with the named profile and watermark version,
+// if any. It includes the version, so that changing a profile, focus or
+// watermark changes the names of the thumbs.
+func Basename(contentHash, name string, profile config.ThumbProfile, focus *Focus, watermark string) string {
+	return VariantBasename(contentHash, name, profile, focus, watermark, profile.Format)
+}
+
+// VariantBasename returns the name of the thumb of a photo rendered with the
+// named profile in another format. It only differs from Basename in the
+// extension.
+func VariantBasename(contentHash, name string, profile config.ThumbProfile, focus *Focus, watermark, format string) string {
+	return fmt.Sprintf("%s_%s_%s%s", contentHash, name, Version(profile, focus, watermark),
+		config.FormatExt(format))
+}
+
+// Path returns the path of a thumb under the thumbs directory, which is
+// sharded by the first two characters of thumb names so that no directory
+// grows too large
+func Path(basename string) string {
+	if len(basename) < 2 {
+		return basename
+	}
+	return path.Join(basename[:2], basename)
+}
+
+// ParseBasename splits a thumb name into the photo content hash and profile
+// name. Whether the version and extension are current is up to the caller.
+func ParseBasename(basename string) (contentHash, profile string, ok bool) {
+	name := strings.TrimSuffix(basename, path.Ext(basename))
+
+	parts := strings.Split(name, "_")
+	if len(parts) != 3 {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
 }
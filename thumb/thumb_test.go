@@ -0,0 +1,101 @@
+package thumb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/agorf/thyme-backend/config"
+)
+
+func TestPath(t *testing.T) {
+	tests := []struct {
+		basename, want string
+	}{
+		{"ab12_small_0123abcd.jpg", "ab/ab12_small_0123abcd.jpg"},
+		{"f7", "f7/f7"},
+		{"f", "f"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Path(tt.basename); got != tt.want {
+			t.Errorf("Path(%q) = %q, want %q", tt.basename, got, tt.want)
+		}
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "photo.jpg")
+	if err := os.WriteFile(path, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := HashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"; hash != want {
+		t.Errorf("HashFile() = %q, want %q", hash, want)
+	}
+
+	if _, err := HashFile(filepath.Join(t.TempDir(), "missing.jpg")); err == nil {
+		t.Error("HashFile() of a missing file succeeded")
+	}
+}
+
+func TestBasename(t *testing.T) {
+	small := config.ThumbProfile{Size: 200, Crop: "centre", Quality: 97, Format: "jpeg"}
+	big := config.ThumbProfile{Size: 1000, Quality: 97, Format: "jpeg"}
+	focus := &Focus{X: 0.2, Y: 0.7}
+
+	base := Basename("ab12", "small", small, nil, "")
+	if want := "ab12_small_" + small.Version() + ".jpg"; base != want {
+		t.Errorf("Basename() = %q, want %q", base, want)
+	}
+
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"focus of an uncropped profile", Basename("ab12", "big", big, focus, ""), Basename("ab12", "big", big, nil, ""), true},
+		{"focus of a cropped profile", Basename("ab12", "small", small, focus, ""), base, false},
+		{"other focus", Basename("ab12", "small", small, &Focus{X: 0.2, Y: 0.8}, ""), Basename("ab12", "small", small, focus, ""), false},
+		{"watermark", Basename("ab12", "small", small, nil, "0badf00d"), base, false},
+		{"other size", Basename("ab12", "small", config.ThumbProfile{Size: 300, Crop: "centre", Quality: 97, Format: "jpeg"}, nil, ""), base, false},
+		{"variants", Basename("ab12", "small", config.ThumbProfile{Size: 200, Crop: "centre", Quality: 97, Format: "jpeg", Variants: []string{"webp"}}, nil, ""), base, true},
+	}
+	for _, tt := range tests {
+		if (tt.a == tt.b) != tt.same {
+			t.Errorf("%s: got %q and %q", tt.name, tt.a, tt.b)
+		}
+	}
+
+	if got := VariantBasename("ab12", "small", small, nil, "", "webp"); got != strings.TrimSuffix(base, ".jpg")+".webp" {
+		t.Errorf("VariantBasename() = %q", got)
+	}
+}
+
+func TestParseBasename(t *testing.T) {
+	tests := []struct {
+		basename    string
+		contentHash string
+		profile     string
+		ok          bool
+	}{
+		{"ab12_small_0123abcd.jpg", "ab12", "small", true},
+		{"ab12_big_0123abcd.webp", "ab12", "big", true},
+		{"ab12_small_0123abcd", "ab12", "small", true},
+		{"ab12_small.jpg", "", "", false},
+		{"ab12_small_0123abcd_x.jpg", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		contentHash, profile, ok := ParseBasename(tt.basename)
+		if contentHash != tt.contentHash || profile != tt.profile || ok != tt.ok {
+			t.Errorf("ParseBasename(%q) = %q, %q, %v, want %q, %q, %v", tt.basename,
+				contentHash, profile, ok, tt.contentHash, tt.profile, tt.ok)
+		}
+	}
+}
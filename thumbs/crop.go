@@ -0,0 +1,170 @@
+package thumbs
+
+import (
+	"image"
+	"math"
+	"os"
+
+	"github.com/agorf/thyme-backend/thumb"
+)
+
+const (
+	entropyBins   = 32 // of the luminance histogram
+	cropPositions = 32 // at most, tried by interestingFocus
+)
+
+var centre = thumb.Focus{X: 0.5, Y: 0.5}
+
+// cropRect returns the rectangle of at most width x height of an image of the
+// given size that is centred on focus as far as the image allows
+func cropRect(size image.Point, width, height int, focus thumb.Focus) image.Rectangle {
+	if width <= 0 || width > size.X {
+		width = size.X
+	}
+	if height <= 0 || height > size.Y {
+		height = size.Y
+	}
+
+	x := int(math.Round(focus.X*float64(size.X))) - width/2
+	y := int(math.Round(focus.Y*float64(size.Y))) - height/2
+	x = min(max(x, 0), size.X-width)
+	y = min(max(y, 0), size.Y-height)
+
+	return image.Rect(x, y, x+width, y+height)
+}
+
+// imageSize returns the width and height of an image as displayed, i.e. with
+// its EXIF orientation applied
+func imageSize(path string) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	orient := orientation(f)
+	if _, err := f.Seek(0, 0); err != nil {
+		return 0, 0, err
+	}
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if orient >= 5 {
+		return cfg.Height, cfg.Width, nil
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// cropFocus returns the point of img, which covers the bounding box in opts,
+// to centre the crop on
+func cropFocus(img *image.RGBA, opts Options) thumb.Focus {
+	switch {
+	case opts.Focus != nil:
+		return *opts.Focus
+	case opts.Gravity == "attention" || opts.Gravity == "entropy":
+		return interestingFocus(img, opts.Width, opts.Height, opts.Gravity)
+	}
+	return centre
+}
+
+func luma(img *image.RGBA, x, y int) int {
+	i := img.PixOffset(x, y)
+	return (299*int(img.Pix[i]) + 587*int(img.Pix[i+1]) + 114*int(img.Pix[i+2])) / 1000
+}
+
+// interestingFocus returns the centre of the width x height window of img
+// with the most detail, measured by the luminance gradients for "attention"
+// and by the entropy of the luminance for "entropy". It approximates the
+// smart crops of vips, sliding the window along the axis that is cropped.
+func interestingFocus(img *image.RGBA, width, height int, gravity string) thumb.Focus {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	horizontal := width > 0 && w > width
+	lines, window := h, height
+	if horizontal {
+		lines, window = w, width
+	}
+	if window <= 0 || window >= lines {
+		return centre
+	}
+
+	// running totals per line across the window axis, so that any window is
+	// the difference of two of them
+	grads := make([]int, lines+1)
+	hists := make([][entropyBins]int, lines+1)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			line := y
+			if horizontal {
+				line = x
+			}
+
+			l := luma(img, img.Rect.Min.X+x, img.Rect.Min.Y+y)
+			hists[line+1][l*entropyBins/256]++
+			if x+1 < w {
+				grads[line+1] += abs(l - luma(img, img.Rect.Min.X+x+1, img.Rect.Min.Y+y))
+			}
+			if y+1 < h {
+				grads[line+1] += abs(l - luma(img, img.Rect.Min.X+x, img.Rect.Min.Y+y+1))
+			}
+		}
+	}
+	for i := 1; i <= lines; i++ {
+		grads[i] += grads[i-1]
+		for b := range hists[i] {
+			hists[i][b] += hists[i-1][b]
+		}
+	}
+
+	score := func(start int) float64 {
+		end := start + window
+		if gravity != "entropy" {
+			return float64(grads[end] - grads[start])
+		}
+
+		var total int
+		var counts [entropyBins]int
+		for b := range counts {
+			counts[b] = hists[end][b] - hists[start][b]
+			total += counts[b]
+		}
+
+		var entropy float64
+		for _, n := range counts {
+			if n > 0 {
+				p := float64(n) / float64(total)
+				entropy -= p * math.Log2(p)
+			}
+		}
+		return entropy
+	}
+
+	// the centre wins ties
+	best := (lines - window) / 2
+	bestScore := score(best)
+	for start := 0; start <= lines-window; start += max(1, (lines-window)/cropPositions) {
+		if s := score(start); s > bestScore {
+			best, bestScore = start, s
+		}
+	}
+
+	focus := centre
+	position := (float64(best) + float64(window)/2) / float64(lines)
+	if horizontal {
+		focus.X = position
+	} else {
+		focus.Y = position
+	}
+	return focus
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,92 @@
+package thumbs
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/agorf/thyme-backend/thumb"
+)
+
+func TestCropRect(t *testing.T) {
+	tests := []struct {
+		name          string
+		size          image.Point
+		width, height int
+		focus         thumb.Focus
+		want          image.Rectangle
+	}{
+		{"centre", image.Pt(400, 200), 200, 200, centre, image.Rect(100, 0, 300, 200)},
+		{"left", image.Pt(400, 200), 200, 200, thumb.Focus{X: 0.3, Y: 0.5}, image.Rect(20, 0, 220, 200)},
+		{"left edge", image.Pt(400, 200), 200, 200, thumb.Focus{X: 0, Y: 0.5}, image.Rect(0, 0, 200, 200)},
+		{"right edge", image.Pt(400, 200), 200, 200, thumb.Focus{X: 1, Y: 0.5}, image.Rect(200, 0, 400, 200)},
+		{"bottom", image.Pt(200, 400), 200, 200, thumb.Focus{X: 0.5, Y: 0.9}, image.Rect(0, 200, 200, 400)},
+		{"larger than image", image.Pt(100, 80), 200, 200, thumb.Focus{X: 0.9, Y: 0.1}, image.Rect(0, 0, 100, 80)},
+		{"unconstrained width", image.Pt(400, 200), 0, 100, thumb.Focus{X: 0.5, Y: 0.25}, image.Rect(0, 0, 400, 100)},
+	}
+	for _, tt := range tests {
+		if got := cropRect(tt.size, tt.width, tt.height, tt.focus); got != tt.want {
+			t.Errorf("%s: cropRect() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// detailed returns a grey image with a checkerboard in the given rectangle
+func detailed(w, h int, busy image.Rectangle) *image.RGBA {
+	img := solid(w, h, color.RGBA{128, 128, 128, 255})
+	for y := busy.Min.Y; y < busy.Max.Y; y++ {
+		for x := busy.Min.X; x < busy.Max.X; x++ {
+			if (x+y)%2 == 0 {
+				img.SetRGBA(x, y, color.RGBA{0, 0, 0, 255})
+			} else {
+				img.SetRGBA(x, y, color.RGBA{255, 255, 255, 255})
+			}
+		}
+	}
+	return img
+}
+
+func TestInterestingFocus(t *testing.T) {
+	tests := []struct {
+		name          string
+		img           *image.RGBA
+		width, height int
+		gravity       string
+		want          thumb.Focus
+	}{
+		{"attention left", detailed(200, 100, image.Rect(0, 0, 40, 100)), 100, 100, "attention", thumb.Focus{X: 0.25, Y: 0.5}},
+		{"attention right", detailed(200, 100, image.Rect(160, 0, 200, 100)), 100, 100, "attention", thumb.Focus{X: 0.75, Y: 0.5}},
+		{"entropy top", detailed(100, 200, image.Rect(0, 0, 100, 30)), 100, 100, "entropy", thumb.Focus{X: 0.5, Y: 0.25}},
+		{"entropy bottom", detailed(100, 200, image.Rect(0, 170, 100, 200)), 100, 100, "entropy", thumb.Focus{X: 0.5, Y: 0.75}},
+		{"flat", solid(200, 100, color.RGBA{128, 128, 128, 255}), 100, 100, "attention", centre},
+		{"not cropped", detailed(100, 100, image.Rect(0, 0, 10, 10)), 100, 100, "attention", centre},
+	}
+	for _, tt := range tests {
+		got := interestingFocus(tt.img, tt.width, tt.height, tt.gravity)
+		if math.Abs(got.X-tt.want.X) > 0.05 || math.Abs(got.Y-tt.want.Y) > 0.05 {
+			t.Errorf("%s: interestingFocus() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCropFocus(t *testing.T) {
+	img := detailed(200, 100, image.Rect(0, 0, 40, 100))
+	focus := &thumb.Focus{X: 0.8, Y: 0.2}
+
+	tests := []struct {
+		name string
+		opts Options
+		want thumb.Focus
+	}{
+		{"centre", Options{Width: 100, Height: 100, Crop: true, Gravity: "centre"}, centre},
+		{"default", Options{Width: 100, Height: 100, Crop: true}, centre},
+		{"attention", Options{Width: 100, Height: 100, Crop: true, Gravity: "attention"}, thumb.Focus{X: 0.25, Y: 0.5}},
+		{"focus wins", Options{Width: 100, Height: 100, Crop: true, Gravity: "attention", Focus: focus}, *focus},
+	}
+	for _, tt := range tests {
+		if got := cropFocus(img, tt.opts); got != tt.want {
+			t.Errorf("%s: cropFocus() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
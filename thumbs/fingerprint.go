@@ -0,0 +1,85 @@
+package thumbs
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/agorf/thyme-backend/database"
+	"github.com/agorf/thyme-backend/thumb"
+)
+
+// CurrentHash returns the hash of the current contents of a photo, which its
+// thumbs and resized images are named after. The photo is only hashed again
+// if its modification time or size changed since it was scanned, so that
+// touching it does not regenerate its thumbs. A new hash is stored for the
+// photo, its thumbs are then rendered under new names and gc removes the old
+// ones.
+func (g *Generator) CurrentHash(photo Photo) (string, error) {
+	if g.DB == nil { // not tracked
+		return photo.Hash, nil
+	}
+
+	fi, err := os.Stat(photo.Path)
+	if err != nil {
+		return "", err
+	}
+
+	var size, mtime sql.NullInt64
+	var hash sql.NullString
+	err = g.DB.QueryRow(`
+	SELECT size, mtime, content_hash FROM photos WHERE path = ?
+	`, photo.Path).Scan(&size, &mtime, &hash)
+	if err == sql.ErrNoRows { // not scanned
+		return photo.Hash, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if hash.Valid && size.Int64 == fi.Size() && mtime.Int64 == fi.ModTime().UnixNano() {
+		return hash.String, nil
+	}
+
+	newHash, err := thumb.HashFile(photo.Path)
+	if err != nil {
+		return "", err
+	}
+
+	// placeholders and difference hashes belong to the old contents, the
+	// latter is computed again by the next scan
+	_, err = g.DB.Exec(`
+	UPDATE photos SET content_hash = ?1, size = ?2, mtime = ?3,
+	blurhash = CASE WHEN content_hash IS ?1 THEN blurhash END,
+	dominant_color = CASE WHEN content_hash IS ?1 THEN dominant_color END,
+	dhash = CASE WHEN content_hash IS ?1 THEN dhash END
+	WHERE path = ?4
+	`, newHash, fi.Size(), fi.ModTime().UnixNano(), photo.Path)
+	if err != nil || !hash.Valid {
+		return newHash, err
+	}
+
+	return newHash, database.CopyFocus(g.DB, newHash, hash.String)
+}
+
+// record records a thumb by its path under the thumbs directory and the
+// contents it was rendered from, which copies of a photo share
+func (g *Generator) record(thumbPath, hash string) error {
+	name, err := filepath.Rel(g.Dir, thumbPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = g.DB.Exec(`
+	INSERT OR REPLACE INTO thumbnails (path, content_hash, created_at)
+	VALUES (?, ?, ?)
+	`, name, hash, time.Now().UTC().Format("2006-01-02 15:04:05"))
+	return err
+}
+
+// exists reports whether a thumb exists. Thumbs are named after the contents
+// they were rendered from, so an existing one is up to date.
+func exists(thumbPath string) bool {
+	_, err := os.Stat(thumbPath)
+	return err == nil
+}
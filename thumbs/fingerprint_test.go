@@ -0,0 +1,161 @@
+package thumbs
+
+import (
+	"context"
+	"database/sql"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/agorf/thyme-backend/config"
+	"github.com/agorf/thyme-backend/database"
+	"github.com/agorf/thyme-backend/thumb"
+)
+
+// writePhoto writes a JPEG photo of a single color
+func writePhoto(t *testing.T, path string, c color.RGBA) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := jpeg.Encode(f, solid(64, 48, c), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setupPhoto scans a photo into a fresh database as scan would, with a
+// placeholder, difference hash and focus, and returns its content hash
+func setupPhoto(t *testing.T, path string) (*sql.DB, string) {
+	db, err := database.Open(filepath.Join(t.TempDir(), "thyme.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	writePhoto(t, path, color.RGBA{200, 0, 0, 255})
+	hash, err := thumb.HashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{
+		`INSERT INTO sets (id, name, thumb_photo_id) VALUES (1, 'set', 1)`,
+		`INSERT INTO photos (id, set_id, path, size, width, height, content_hash, mtime, blurhash, dominant_color, dhash)
+		VALUES (1, 1, ?1, ?2, 64, 48, ?3, ?4, 'L00000', '#c80000', '0000000000000000')`,
+		`INSERT INTO focal_points (content_hash, focal_x, focal_y) VALUES (?3, 0.25, 0.75)`,
+	} {
+		if _, err := db.Exec(query, path, fi.Size(), hash, fi.ModTime().UnixNano()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db, hash
+}
+
+func TestCurrentHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "photo.jpg")
+	db, oldHash := setupPhoto(t, path)
+	g := &Generator{DB: db}
+
+	// unchanged photos are not hashed again
+	if hash, err := g.CurrentHash(Photo{Path: path, Hash: "stale"}); err != nil || hash != oldHash {
+		t.Errorf("unchanged: got %q, %v, want %q", hash, err, oldHash)
+	}
+	if hash, err := g.CurrentHash(Photo{Path: path + ".missing"}); err == nil {
+		t.Errorf("missing: got %q", hash)
+	}
+	untracked := &Generator{}
+	if hash, err := untracked.CurrentHash(Photo{Path: path, Hash: "given"}); err != nil || hash != "given" {
+		t.Errorf("without database: got %q, %v", hash, err)
+	}
+
+	writePhoto(t, path, color.RGBA{0, 0, 200, 255})
+	newHash, err := thumb.HashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash, err := g.CurrentHash(Photo{Path: path, Hash: oldHash}); err != nil || hash != newHash {
+		t.Fatalf("edited: got %q, %v, want %q", hash, err, newHash)
+	}
+
+	// what belonged to the old contents is cleared, but the focus is kept
+	var stored string
+	var blurHash, dominantColor, dHash sql.NullString
+	err = db.QueryRow(`
+	SELECT content_hash, blurhash, dominant_color, dhash FROM photos WHERE id = 1
+	`).Scan(&stored, &blurHash, &dominantColor, &dHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != newHash || blurHash.Valid || dominantColor.Valid || dHash.Valid {
+		t.Errorf("edited: stored %q, %v, %v, %v", stored, blurHash, dominantColor, dHash)
+	}
+
+	var x, y float64
+	if err := db.QueryRow(`
+	SELECT focal_x, focal_y FROM focal_points WHERE content_hash = ?
+	`, newHash).Scan(&x, &y); err != nil || x != 0.25 || y != 0.75 {
+		t.Errorf("edited: focus %g, %g, %v", x, y, err)
+	}
+}
+
+// Generate works on the current contents of a photo that changed after it
+// was selected
+func TestGenerateEdited(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "photo.jpg")
+	db, oldHash := setupPhoto(t, path)
+
+	thumbnailer, err := NewThumbnailer("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Generator{
+		Dir:         filepath.Join(dir, "thumbs"),
+		Thumbnailer: thumbnailer,
+		Profiles:    map[string]config.ThumbProfile{"small": {Size: 32, Quality: 90, Format: "jpeg", Color: "srgb"}},
+		DB:          db,
+	}
+
+	writePhoto(t, path, color.RGBA{0, 0, 200, 255})
+	newHash, err := thumb.HashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Generate(context.Background(), Photo{Path: path, Hash: oldHash, placeholder: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	var statusHash, thumbHash string
+	if err := db.QueryRow(`SELECT content_hash FROM thumb_status WHERE photo_path = ?`, path).Scan(&statusHash); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT content_hash FROM thumbnails`).Scan(&thumbHash); err != nil {
+		t.Fatal(err)
+	}
+	if statusHash != newHash || thumbHash != newHash {
+		t.Errorf("recorded under %q and %q, want %q", statusHash, thumbHash, newHash)
+	}
+
+	// the placeholder of the old contents was cleared and sampled again
+	var dominantColor sql.NullString
+	if err := db.QueryRow(`SELECT dominant_color FROM photos WHERE id = 1`).Scan(&dominantColor); err != nil {
+		t.Fatal(err)
+	}
+	if !dominantColor.Valid || dominantColor.String == "#c80000" {
+		t.Errorf("dominant color is %v", dominantColor)
+	}
+
+	basename := thumb.Basename(newHash, "small", g.Profiles["small"], nil, "")
+	if _, err := os.Stat(filepath.Join(g.Dir, thumb.Path(basename))); err != nil {
+		t.Error(err)
+	}
+}
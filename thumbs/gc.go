@@ -0,0 +1,174 @@
+package thumbs
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/agorf/thyme-backend/config"
+	"github.com/agorf/thyme-backend/database"
+	"github.com/agorf/thyme-backend/thumb"
+)
+
+// SizedDir is the subdirectory of the thumbs directory that resized images
+// are cached in
+const SizedDir = "sized"
+
+// temporary files older than this are left over from interrupted runs
+const staleTempFileAge = time.Hour
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// expectedThumbs returns the paths under the thumbs directory of the thumbs
+// of all photos, in every profile format and variant and also watermarked for
+// shared photos, and the content hashes of the photos, which resized images
+// are named after
+func expectedThumbs(g *Generator, photos []Photo) (map[string]bool, map[string]bool) {
+	thumbs, hashes := map[string]bool{}, map[string]bool{}
+
+	for _, photo := range photos {
+		hashes[photo.Hash] = true
+
+		for _, rendition := range g.renditions(photo) {
+			for name, profile := range g.Profiles {
+				for _, format := range append([]string{profile.Format}, profile.Variants...) {
+					basename, _ := g.Basename(rendition, name, format)
+					thumbs[thumb.Path(basename)] = true
+				}
+			}
+		}
+	}
+
+	return thumbs, hashes
+}
+
+// isGarbage reports whether a file under the thumbs directory belongs to no
+// photo in the database
+func isGarbage(rel string, d fs.DirEntry, thumbs, hashes map[string]bool) bool {
+	name := d.Name()
+
+	if strings.HasPrefix(name, ".") { // temporary file
+		info, err := d.Info()
+		return err == nil && time.Since(info.ModTime()) > staleTempFileAge
+	}
+
+	if strings.HasPrefix(rel, SizedDir+string(filepath.Separator)) {
+		hash, _, _ := strings.Cut(name, "_")
+		return !hashes[hash]
+	}
+
+	return !thumbs[rel]
+}
+
+// GC removes the files in the thumbs directory that do not belong to any
+// photo in the database, e.g. thumbs of deleted or moved photos and of old
+// profile versions, or only lists them if dryRun is set
+func GC(thymePath string, dryRun bool) {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := database.Open(cfg.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// thumbs of photos that failed are not garbage either
+	photos, _, err := selectPhotos(db, GenerateOptions{RetryFailed: true})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	thumbsPath, err := filepath.Abs(path.Join(thymePath, thumbsDir))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	g := &Generator{Dir: thumbsPath, Profiles: cfg.ThumbProfiles, Watermark: cfg.Watermark}
+	thumbs, hashes := expectedThumbs(g, photos)
+
+	var count, size int64
+
+	err = filepath.WalkDir(thumbsPath, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(thumbsPath, filePath)
+		if err != nil {
+			return err
+		}
+		if !isGarbage(rel, d, thumbs, hashes) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if dryRun {
+			fmt.Println(filePath)
+		} else {
+			if err := os.Remove(filePath); err != nil {
+				return err
+			}
+			if _, err := db.Exec("DELETE FROM thumbnails WHERE path = ?", rel); err != nil {
+				return err
+			}
+		}
+
+		count++
+		size += info.Size()
+
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if dryRun {
+		fmt.Printf("Would remove %d files (%s)\n", count, formatBytes(size))
+		return
+	}
+
+	// records of thumbs that were removed by other means
+	_, err = db.Exec(`
+	DELETE FROM thumbnails WHERE content_hash NOT IN (
+		SELECT content_hash FROM photos WHERE content_hash IS NOT NULL
+	)
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+	DELETE FROM thumb_status WHERE photo_path NOT IN (SELECT path FROM photos)
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Removed %d files, reclaiming %s\n", count, formatBytes(size))
+}
@@ -0,0 +1,46 @@
+//go:build linux
+
+package thumbs
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const (
+	lowNice          = 19
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// lowerPriority makes thyme and the programs it runs yield CPU and disk to
+// other processes, like nice -n 19 and ionice -c 3 would. Linux keeps
+// priorities per thread, so every thread is changed and new ones inherit
+// them.
+func lowerPriority() error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, lowNice); err != nil {
+			return err
+		}
+
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid),
+			ioprioClassIdle<<ioprioClassShift)
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	return nil
+}
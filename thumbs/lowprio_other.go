@@ -0,0 +1,12 @@
+//go:build !linux
+
+package thumbs
+
+import (
+	"errors"
+	"runtime"
+)
+
+func lowerPriority() error {
+	return errors.New("not supported on " + runtime.GOOS)
+}
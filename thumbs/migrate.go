@@ -0,0 +1,92 @@
+package thumbs
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/agorf/thyme-backend/config"
+	"github.com/agorf/thyme-backend/database"
+	"github.com/agorf/thyme-backend/thumb"
+)
+
+// migrateDir moves the thumbs directly under dir into shard subdirectories,
+// updating their records, and returns how many it moved
+func migrateDir(thumbsPath, dir string, update func(oldRel, newRel string) error) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		oldPath := filepath.Join(dir, name)
+		newPath := filepath.Join(dir, thumb.Path(name))
+		if newPath == oldPath {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(newPath), os.ModeDir|0755); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(oldPath, newPath); err != nil {
+			return moved, err
+		}
+
+		oldRel, _ := filepath.Rel(thumbsPath, oldPath)
+		newRel, _ := filepath.Rel(thumbsPath, newPath)
+		if err := update(oldRel, newRel); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+
+	return moved, nil
+}
+
+// Migrate moves thumbs from the flat layout of earlier versions into shard
+// subdirectories. It can be run again if interrupted.
+func Migrate(thymePath string) {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := database.Open(cfg.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	thumbsPath, err := filepath.Abs(path.Join(thymePath, thumbsDir))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	update := func(oldRel, newRel string) error {
+		_, err := db.Exec("UPDATE thumbnails SET path = ? WHERE path = ?", newRel, oldRel)
+		return err
+	}
+
+	total := 0
+	for _, dir := range []string{thumbsPath, filepath.Join(thumbsPath, SizedDir)} {
+		moved, err := migrateDir(thumbsPath, dir, update)
+		total += moved
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Printf("Moved %d files\n", total)
+}
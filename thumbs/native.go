@@ -0,0 +1,257 @@
+package thumbs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif" // register decoders
+	"image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/agorf/goexif/exif"
+	"github.com/agorf/thyme-backend/icc"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // for thumbs rendered from larger ones
+)
+
+// goThumbnailer renders thumbs with the standard library and x/image, so it
+// works without any external program. It only writes JPEG and cannot keep
+// metadata.
+type goThumbnailer struct{}
+
+func (goThumbnailer) String() string { return "go" }
+
+func (goThumbnailer) CanWrite(format string) bool { return format == "jpeg" }
+
+// orientation returns the EXIF orientation of the image in f, or 1 if it has
+// none
+func orientation(f *os.File) int {
+	x, err := exif.Decode(f)
+	if err != nil {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	if orient, err := tag.Int(0); err == nil && orient >= 1 && orient <= 8 {
+		return orient
+	}
+	return 1
+}
+
+// decodeImage returns an image with its EXIF orientation and ICC profile, if
+// it has one
+func decodeImage(srcPath string) (image.Image, int, []byte, error) {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer f.Close()
+
+	orient := orientation(f)
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, 0, nil, err
+	}
+
+	profile, _ := icc.FromJPEG(f) // other formats have none
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, 0, nil, err
+	}
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return img, orient, profile, nil
+}
+
+// scaleFactor returns how much an image of width x height has to be scaled to
+// fit within (or cover, if crop is set) the bounding box in opts
+func scaleFactor(width, height int, opts Options) float64 {
+	sx := float64(opts.Width) / float64(width)
+	sy := float64(opts.Height) / float64(height)
+
+	var scale float64
+	switch {
+	case opts.Width <= 0 && opts.Height <= 0:
+		scale = 1
+	case opts.Width <= 0:
+		scale = sy
+	case opts.Height <= 0:
+		scale = sx
+	case opts.Crop:
+		scale = math.Max(sx, sy)
+	default:
+		scale = math.Min(sx, sy)
+	}
+
+	if scale > 1 && !opts.Upscale {
+		scale = 1
+	}
+	return scale
+}
+
+// orient returns a copy of img transformed according to an EXIF orientation
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 {
+		return img
+	}
+
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 { // rotated
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx, sy = w-1-dx, dy
+			case 3: // rotated 180
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // mirrored vertically
+				sx, sy = dx, h-1-dy
+			case 5: // transposed
+				sx, sy = dy, dx
+			case 6: // rotated 90 CW
+				sx, sy = dy, h-1-dx
+			case 7: // transversed
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // rotated 90 CCW
+				sx, sy = w-1-dy, dx
+			}
+			si := img.PixOffset(sx, sy)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], img.Pix[si:si+4])
+		}
+	}
+
+	return dst
+}
+
+// sharpen applies an unsharp mask with a 3x3 box blur to img
+func sharpen(img *image.RGBA) *image.RGBA {
+	const amount = 0.6
+
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	dst := image.NewRGBA(img.Rect)
+	copy(dst.Pix, img.Pix) // borders stay as they are
+
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := img.PixOffset(x, y)
+			for c := 0; c < 3; c++ { // alpha is left alone
+				var sum int
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						sum += int(img.Pix[img.PixOffset(x+dx, y+dy)+c])
+					}
+				}
+				v := float64(img.Pix[i+c])
+				v += amount * (v - float64(sum)/9)
+				dst.Pix[i+c] = uint8(math.Max(0, math.Min(255, math.Round(v))))
+			}
+		}
+	}
+
+	return dst
+}
+
+// Thumbnail cannot be interrupted while decoding or resizing, so ctx is only
+// checked in between
+func (goThumbnailer) Thumbnail(ctx context.Context, srcPath, dstPath string, opts Options) error {
+	switch filepath.Ext(dstPath) {
+	case ".jpg", ".jpeg":
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedFormat, filepath.Ext(dstPath))
+	}
+
+	src, orientation, profile, err := decodeImage(srcPath)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// the bounding box applies to the image as displayed
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+	dispWidth, dispHeight := srcWidth, srcHeight
+	if orientation >= 5 {
+		dispWidth, dispHeight = srcHeight, srcWidth
+	}
+
+	scale := scaleFactor(dispWidth, dispHeight, opts)
+	width := max(1, int(math.Round(float64(srcWidth)*scale)))
+	height := max(1, int(math.Round(float64(srcHeight)*scale)))
+
+	// Catmull-Rom is slow on large sources, so shrink them roughly first
+	if srcWidth > 4*width && srcHeight > 4*height {
+		tmp := image.NewRGBA(image.Rect(0, 0, 2*width, 2*height))
+		draw.ApproxBiLinear.Scale(tmp, tmp.Rect, src, src.Bounds(), draw.Src, nil)
+		src = tmp
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Rect, src, src.Bounds(), draw.Src, nil)
+
+	// convert colors to sRGB, which browsers assume, unless the profile is to
+	// be kept. Profiles that cannot be converted tag the thumb instead.
+	if profile != nil && !opts.KeepProfile {
+		if strings.Contains(icc.Description(profile), "sRGB") {
+			profile = nil
+		} else if t, err := icc.NewTransform(profile); err == nil {
+			t.Apply(dst.Pix)
+			profile = nil
+		}
+	}
+
+	oriented := orient(dst, orientation)
+	if opts.Sharpen {
+		oriented = sharpen(oriented)
+	}
+
+	var thumb image.Image = oriented
+	if opts.Crop {
+		rect := cropRect(oriented.Rect.Size(), opts.Width, opts.Height, cropFocus(oriented, opts))
+		thumb = oriented.SubImage(rect)
+	}
+	if opts.Watermark != nil {
+		if thumb, err = overlayWatermark(thumb, opts.Watermark); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: opts.Quality}); err != nil {
+		return err
+	}
+
+	f, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+
+	if profile != nil {
+		err = icc.EmbedJPEG(f, buf.Bytes(), profile)
+	} else {
+		_, err = f.Write(buf.Bytes())
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package thumbs
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/agorf/thyme-backend/config"
+	"golang.org/x/image/draw"
+)
+
+const (
+	placeholderSize    = 32 // pixels on the longest side of the image sampled
+	blurHashComponents = 4  // along the longest side, 3 along the other
+	dominantColorBits  = 4  // per channel, of the colors counted
+	blurHashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// encode83 encodes n in base 83 with length digits, as BlurHash does
+func encode83(n, length int) string {
+	digits := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		digits[i] = blurHashCharacters[n%83]
+		n /= 83
+	}
+	return string(digits)
+}
+
+func sRGBToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(f float64) int {
+	f = math.Max(0, math.Min(1, f))
+	if f <= 0.0031308 {
+		return int(f*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(f, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow raises the magnitude of v to exp, keeping its sign
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// blurHash returns the BlurHash (https://blurha.sh) of img with xComponents
+// by yComponents cosine components
+func blurHash(img *image.RGBA, xComponents, yComponents int) string {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) *
+						math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+					for c := range f {
+						f[c] += basis * sRGBToLinear(img.Pix[p+c])
+					}
+				}
+			}
+			for c := range f {
+				f[c] *= norm / float64(w*h)
+			}
+			factors = append(factors, f)
+		}
+	}
+
+	dc, ac := factors[0], factors[1:]
+
+	hash := encode83(xComponents-1+(yComponents-1)*9, 1)
+
+	maxValue := 1.0
+	if len(ac) > 0 {
+		var actualMax float64
+		for _, f := range ac {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantised := max(0, min(82, int(math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantised+1) / 166
+		hash += encode83(quantised, 1)
+	} else {
+		hash += encode83(0, 1)
+	}
+
+	hash += encode83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+
+	for _, f := range ac {
+		var q [3]int
+		for c, v := range f {
+			q[c] = max(0, min(18, int(math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		hash += encode83(q[0]*19*19+q[1]*19+q[2], 2)
+	}
+
+	return hash
+}
+
+// dominantColor returns the most common color of img as "#rrggbb", counting
+// similar colors together and averaging them
+func dominantColor(img *image.RGBA) string {
+	const shift = 8 - dominantColorBits
+
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := map[int]*bucket{}
+	var best *bucket
+
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			p := img.PixOffset(x, y)
+			r, g, b := int(img.Pix[p]), int(img.Pix[p+1]), int(img.Pix[p+2])
+
+			key := (r>>shift)<<(2*dominantColorBits) | (g>>shift)<<dominantColorBits | b>>shift
+			bk := buckets[key]
+			if bk == nil {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.count++
+			bk.r, bk.g, bk.b = bk.r+r, bk.g+g, bk.b+b
+
+			if best == nil || bk.count > best.count {
+				best = bk
+			}
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count)
+}
+
+// placeholderImage returns a photo scaled down to placeholderSize as
+// displayed, sampled from its smallest plain thumb if there is one
+func (g *Generator) placeholderImage(photo Photo) (*image.RGBA, error) {
+	src, orientation, _, err := decodeImage(g.source(photo, config.ThumbProfile{
+		Size:  placeholderSize,
+		Color: "srgb",
+	}))
+	if err != nil { // thumbs in formats that cannot be decoded
+		src, orientation, _, err = decodeImage(photo.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b := src.Bounds()
+	scale := math.Min(1, float64(placeholderSize)/float64(max(b.Dx(), b.Dy())))
+	img := image.NewRGBA(image.Rect(0, 0,
+		max(1, int(math.Round(float64(b.Dx())*scale))),
+		max(1, int(math.Round(float64(b.Dy())*scale)))))
+	draw.ApproxBiLinear.Scale(img, img.Rect, src, b, draw.Src, nil)
+
+	return orient(img, orientation), nil
+}
+
+// hasPlaceholder reports whether the contents of a photo have a placeholder
+func (g *Generator) hasPlaceholder(photo Photo) (bool, error) {
+	if g.DB == nil {
+		return false, nil
+	}
+
+	var has bool
+	err := g.DB.QueryRow(`
+	SELECT EXISTS (
+		SELECT 1 FROM photos WHERE content_hash = ? AND blurhash IS NOT NULL
+	)
+	`, photo.Hash).Scan(&has)
+	return has, err
+}
+
+// recordPlaceholder stores a BlurHash and the dominant color of a photo,
+// which clients show while its thumbs load, for it and its copies
+func (g *Generator) recordPlaceholder(photo Photo) error {
+	if g.DB == nil {
+		return nil
+	}
+
+	img, err := g.placeholderImage(photo)
+	if err != nil {
+		return err
+	}
+
+	xComponents, yComponents := blurHashComponents, blurHashComponents-1
+	if img.Rect.Dy() > img.Rect.Dx() {
+		xComponents, yComponents = yComponents, xComponents
+	}
+
+	_, err = g.DB.Exec(`
+	UPDATE photos SET blurhash = ?, dominant_color = ? WHERE content_hash = ?
+	`, blurHash(img, xComponents, yComponents), dominantColor(img), photo.Hash)
+	return err
+}
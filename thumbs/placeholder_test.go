@@ -0,0 +1,106 @@
+package thumbs
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func solid(w, h int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestEncode83(t *testing.T) {
+	tests := []struct {
+		n, length int
+		want      string
+	}{
+		{0, 1, "0"},
+		{82, 1, "~"},
+		{83, 2, "10"},
+		{0xffffff, 4, "TSUA"},
+		{3429, 2, "fQ"},
+	}
+	for _, tt := range tests {
+		if got := encode83(tt.n, tt.length); got != tt.want {
+			t.Errorf("encode83(%d, %d) = %q, want %q", tt.n, tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestBlurHash(t *testing.T) {
+	tests := []struct {
+		name string
+		img  *image.RGBA
+		x, y int
+		want string
+	}{
+		{"black", solid(8, 6, color.RGBA{0, 0, 0, 255}), 4, 3, "L00000" + strings.Repeat("fQ", 11)},
+		{"white", solid(4, 4, color.RGBA{255, 255, 255, 255}), 1, 1, "00TSUA"},
+		{"grey", solid(4, 4, color.RGBA{0x80, 0x80, 0x80, 255}), 1, 1, "00Eyb["},
+	}
+	for _, tt := range tests {
+		if got := blurHash(tt.img, tt.x, tt.y); got != tt.want {
+			t.Errorf("%s: blurHash() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// mirrored gradients differ in the sign of the first horizontal component
+	left := image.NewRGBA(image.Rect(0, 0, 16, 4))
+	right := image.NewRGBA(image.Rect(0, 0, 16, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 16; x++ {
+			v := uint8(x * 17)
+			left.SetRGBA(x, y, color.RGBA{v, v, v, 255})
+			right.SetRGBA(15-x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	l, r := blurHash(left, 4, 3), blurHash(right, 4, 3)
+	if len(l) != 6+2*11 || l[0] != 'L' {
+		t.Fatalf("gradient: got %q", l)
+	}
+	if l[2:6] != r[2:6] {
+		t.Errorf("mirrored gradients have different averages: %q and %q", l, r)
+	}
+	if l[6:8] == r[6:8] {
+		t.Errorf("mirrored gradients have the same first component: %q", l)
+	}
+}
+
+func TestDominantColor(t *testing.T) {
+	mixed := solid(10, 10, color.RGBA{200, 10, 10, 255})
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 10; y++ {
+			mixed.SetRGBA(x, y, color.RGBA{10, 10, 200, 255})
+		}
+	}
+
+	// similar colors count together and are averaged
+	similar := solid(2, 2, color.RGBA{100, 100, 100, 255})
+	similar.SetRGBA(0, 0, color.RGBA{102, 102, 102, 255})
+	similar.SetRGBA(1, 1, color.RGBA{30, 30, 30, 255})
+
+	tests := []struct {
+		name string
+		img  *image.RGBA
+		want string
+	}{
+		{"solid", solid(3, 3, color.RGBA{0x12, 0x34, 0x56, 255}), "#123456"},
+		{"mixed", mixed, "#c80a0a"},
+		{"similar", similar, "#646464"},
+		{"sub-image", mixed.SubImage(image.Rect(0, 0, 3, 10)).(*image.RGBA), "#0a0ac8"},
+		{"empty", image.NewRGBA(image.Rect(0, 0, 0, 0)), ""},
+	}
+	for _, tt := range tests {
+		if got := dominantColor(tt.img); got != tt.want {
+			t.Errorf("%s: dominantColor() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
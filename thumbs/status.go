@@ -0,0 +1,86 @@
+package thumbs
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// recordStatus records whether the thumbs of a photo were generated, so that
+// photos that fail, e.g. because they are corrupt, are not retried by every
+// run. Failures are counted until the photo succeeds again.
+func (g *Generator) recordStatus(photo Photo, genErr error) error {
+	if g.DB == nil {
+		return nil
+	}
+
+	status, message := "ok", sql.NullString{}
+	if genErr != nil {
+		status, message = "failed", sql.NullString{String: genErr.Error(), Valid: true}
+	}
+
+	_, err := g.DB.Exec(`
+	INSERT INTO thumb_status
+	(photo_path, content_hash, status, error, attempts, last_attempt_at)
+	VALUES (?1, ?2, ?3, ?4, CASE ?3 WHEN 'failed' THEN 1 ELSE 0 END, ?5)
+	ON CONFLICT (photo_path) DO UPDATE SET
+	content_hash = excluded.content_hash,
+	status = excluded.status,
+	error = excluded.error,
+	attempts = CASE
+		WHEN excluded.status = 'ok' THEN 0
+		WHEN thumb_status.content_hash = excluded.content_hash THEN thumb_status.attempts + 1
+		ELSE 1
+	END,
+	last_attempt_at = excluded.last_attempt_at
+	`, photo.Path, photo.Hash, status, message,
+		time.Now().UTC().Format("2006-01-02 15:04:05"))
+	return err
+}
+
+// Generate creates all thumbs of a photo within Timeout, and its placeholder
+// unless it has one, and records the outcome
+func (g *Generator) Generate(ctx context.Context, photo Photo) error {
+	if g.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.Timeout)
+		defer cancel()
+	}
+
+	// the photo may have changed since it was selected, its thumbs, status
+	// and placeholder then belong to the new contents
+	hash, err := g.CurrentHash(photo)
+	if err == nil && hash != photo.Hash {
+		photo.Hash = hash
+		photo.placeholder, err = g.hasPlaceholder(photo)
+	}
+	if err == nil {
+		err = generateThumbs(ctx, g, photo)
+	}
+	if err == nil && (!photo.placeholder || g.Force) {
+		err = g.recordPlaceholder(photo) // from the new thumbs
+	}
+	if statusErr := g.recordStatus(photo, err); statusErr != nil && err == nil {
+		err = statusErr
+	}
+	return err
+}
+
+// RecordThumbStatus records the outcome of generating a single thumb of a
+// photo on demand. Successes only clear earlier failures, since other thumbs
+// of the photo may still be missing.
+func (g *Generator) RecordThumbStatus(photo Photo, genErr error) error {
+	if g.DB == nil {
+		return nil
+	}
+	if genErr != nil {
+		return g.recordStatus(photo, genErr)
+	}
+
+	_, err := g.DB.Exec(`
+	UPDATE thumb_status SET status = 'ok', error = NULL, attempts = 0,
+	last_attempt_at = ?
+	WHERE photo_path = ? AND status = 'failed'
+	`, time.Now().UTC().Format("2006-01-02 15:04:05"), photo.Path)
+	return err
+}
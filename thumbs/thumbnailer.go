@@ -0,0 +1,69 @@
+package thumbs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"github.com/agorf/thyme-backend/thumb"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported thumb format")
+
+// Options describe how to render a thumb
+type Options struct {
+	Width   int  // bounding box, where 0 leaves a dimension unconstrained
+	Height  int  //
+	Crop    bool // fill the bounding box, cropping the image
+	Upscale bool // enlarge images smaller than the bounding box
+	Quality int  // 1-100
+	Sharpen bool // after resizing
+
+	// which part of the image to crop: "centre" (the default), "attention"
+	// or "entropy", which look for the most interesting part, unless Focus
+	// is set
+	Gravity string
+	Focus   *thumb.Focus
+
+	// keep EXIF and ICC data, which the go thumbnailer cannot do
+	KeepMetadata bool
+
+	// tag the thumb with the ICC profile of the image instead of converting it
+	// to sRGB, which the go thumbnailer can only do for matrix profiles, so it
+	// tags thumbs of images with other profiles either way
+	KeepProfile bool
+
+	Watermark *Mark // to overlay, if any
+}
+
+// Thumbnailer renders a thumb of the image at srcPath into dstPath, in the
+// format implied by the extension of dstPath, applying the EXIF orientation.
+// It gives up when ctx is done.
+type Thumbnailer interface {
+	Thumbnail(ctx context.Context, srcPath, dstPath string, opts Options) error
+}
+
+// implemented by thumbnailers that cannot write every format
+type formatChecker interface {
+	CanWrite(format string) bool
+}
+
+// NewThumbnailer returns the thumbnailer with the given name: "vips", which
+// runs vipsthumbnail, "go", which needs nothing installed, or "auto" (or
+// empty), which picks vips if vipsthumbnail is in PATH
+func NewThumbnailer(name string) (Thumbnailer, error) {
+	switch name {
+	case "vips":
+		return vipsThumbnailer{}, nil
+	case "go":
+		return goThumbnailer{}, nil
+	case "", "auto":
+		if _, err := exec.LookPath(vipsCommand); err == nil {
+			return vipsThumbnailer{}, nil
+		}
+		return goThumbnailer{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown thumbnailer %q", name)
+}
@@ -1,95 +1,446 @@
 package thumbs
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
-	"strconv"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/agorf/thyme-backend/config"
+	"github.com/agorf/thyme-backend/database"
+	"github.com/agorf/thyme-backend/progress"
 	"github.com/agorf/thyme-backend/thumb"
-	"github.com/cheggaaa/pb"
-	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/sync/semaphore"
 )
 
 const (
-	bigThumbSize   = 1000
-	smallThumbSize = 200
-	thumbsDir      = "public/thumbs"
-	workers        = 4 // should be at least 1
+	thumbsDir        = "public/thumbs"
+	imageQuality     = 85 // of resized images
+	logFileName      = "thyme-generate-thumbs.log"
+	bytesPerPixel    = 4 // of decoded photos, which is what memory is spent on
+	bytesPerMegaByte = 1 << 20
 )
 
-var thumbsPath string
+// Photo is a photo to render thumbs of
+type Photo struct {
+	Path   string
+	Hash   string // of the contents, which thumbs are named after
+	Pixels int64  // width times height, if known
+	Focus  *thumb.Focus
 
-func generateThumb(photoPath, thumbPath string, thumbSize int, crop bool) error {
-	if _, err := os.Stat(thumbPath); err == nil { // file exists
+	// render thumbs with the watermark, as served through share links
+	Watermark bool
+
+	shared      bool // through an active share link
+	placeholder bool // whether it has a BlurHash and dominant color
+}
+
+// Generator writes thumbs into Dir, naming them after the content hashes of
+// the photos and the profiles they are rendered with
+type Generator struct {
+	Dir         string
+	Thumbnailer Thumbnailer
+	Profiles    map[string]config.ThumbProfile
+	DB          *sql.DB       // where photo fingerprints are recorded, if set
+	Force       bool          // regenerate thumbs that are up to date
+	Timeout     time.Duration // for all thumbs of a photo, if set
+	Watermark   *config.Watermark
+
+	markOnce sync.Once
+	mark     *Mark
+}
+
+// watermark returns the watermark of the thumbs of a photo rendered with the
+// named profile, or nil if they have none
+func (g *Generator) watermark(photo Photo, name string) *Mark {
+	if g.Watermark == nil {
+		return nil
+	}
+	if photo.Watermark || slices.Contains(g.Watermark.Profiles, name) {
+		g.markOnce.Do(func() { g.mark = &Mark{Watermark: g.Watermark} })
+		return g.mark
+	}
+	return nil
+}
+
+// Basename returns the name of the thumb of a photo rendered with the named
+// profile in a format, where "" stands for the profile format, or false if
+// there is no such profile
+func (g *Generator) Basename(photo Photo, name, format string) (string, bool) {
+	profile, ok := g.Profiles[name]
+	if !ok {
+		return "", false
+	}
+	if format == "" {
+		format = profile.Format
+	}
+
+	var watermark string
+	if wm := g.watermark(photo, name); wm != nil {
+		watermark = wm.Version()
+	}
+	return thumb.VariantBasename(photo.Hash, name, profile, photo.Focus, watermark, format), true
+}
+
+// CanWrite reports whether the thumbnailer can write a format
+func (g *Generator) CanWrite(format string) bool {
+	fc, ok := g.Thumbnailer.(formatChecker)
+	return !ok || fc.CanWrite(format)
+}
+
+// Variants returns the variant formats of the named profile that the
+// thumbnailer can write
+func (g *Generator) Variants(name string) []string {
+	var formats []string
+	for _, format := range g.Profiles[name].Variants {
+		if g.CanWrite(format) {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+// ProfileNames returns the names of the profiles from the largest to the
+// smallest, which is the order that lets Thumb reuse larger thumbs
+func (g *Generator) ProfileNames() []string {
+	names := make([]string, 0, len(g.Profiles))
+	for name := range g.Profiles {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := g.Profiles[names[i]], g.Profiles[names[j]]
+		if pi.Size != pj.Size {
+			return pi.Size > pj.Size
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// source returns the smallest existing thumb of a photo that a thumb can be
+// rendered from instead of the photo itself, for speed, or the photo path
+func (g *Generator) source(photo Photo, profile config.ThumbProfile) string {
+	source, sourceSize := photo.Path, 0
+	photo.Watermark = false
+
+	for name, p := range g.Profiles {
+		// thumbs must be large enough and unaltered besides resizing
+		if p.Crop != "" || p.Sharpen || p.Color != profile.Color || p.Size < 2*profile.Size {
+			continue
+		}
+		if g.watermark(photo, name) != nil {
+			continue
+		}
+		if sourceSize > 0 && p.Size >= sourceSize {
+			continue
+		}
+
+		basename, _ := g.Basename(photo, name, "")
+		thumbPath := path.Join(g.Dir, thumb.Path(basename))
+		if exists(thumbPath) {
+			source, sourceSize = thumbPath, p.Size
+		}
+	}
+
+	return source
+}
+
+// Job is a thumb or resized image of a photo to render. It is prepared with
+// the database at hand and rendered without it, so that the database can be
+// reloaded meanwhile.
+type Job struct {
+	Path string // where it is written
+
+	hash    string // of the photo contents it is rendered from
+	srcPath string // the photo or a larger thumb of it
+	opts    Options
+	current bool
+}
+
+// Current reports whether the job output is up to date and need not be
+// rendered
+func (j *Job) Current() bool {
+	return j.current
+}
+
+func (g *Generator) job(hash, srcPath, outPath string, opts Options) *Job {
+	return &Job{
+		Path:    outPath,
+		hash:    hash,
+		srcPath: srcPath,
+		opts:    opts,
+		current: !g.Force && exists(outPath),
+	}
+}
+
+// Render writes the output of a job, without touching the database
+func (g *Generator) Render(ctx context.Context, j *Job) error {
+	if err := os.MkdirAll(filepath.Dir(j.Path), os.ModeDir|0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that a partly written thumb is never
+	// served
+	tmpFile, err := os.CreateTemp(filepath.Dir(j.Path), ".*"+filepath.Ext(j.Path))
+	if err != nil {
 		return err
 	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name()) // in case of failure
 
-	vipsOpts := []string{
-		"--rotate",
-		"--size", strconv.Itoa(thumbSize),
-		"--interpolator", "bicubic",
-		"--output", thumbPath + "[Q=97,no_subsample,strip]",
+	if err := g.Thumbnailer.Thumbnail(ctx, j.srcPath, tmpFile.Name(), j.opts); err != nil {
+		return err
 	}
 
-	if crop {
-		vipsOpts = append(vipsOpts, "--crop")
+	return os.Rename(tmpFile.Name(), j.Path)
+}
+
+// Record records the output of a job and the contents it was rendered from
+func (g *Generator) Record(j *Job) error {
+	if g.DB == nil {
+		return nil
 	}
+	return g.record(j.Path, j.hash)
+}
 
-	cmdArgs := append([]string{photoPath}, vipsOpts...)
-	return exec.Command("vipsthumbnail", cmdArgs...).Run()
+// run renders and records a job unless it is up to date
+func (g *Generator) run(ctx context.Context, j *Job) error {
+	if j.current {
+		return nil
+	}
+	if err := g.Render(ctx, j); err != nil {
+		return err
+	}
+	return g.Record(j)
 }
 
-func generateThumbs(photoPath string) (err error) {
-	smallThumbPhotoPath := photoPath
-	bigThumbPath := path.Join(thumbsPath, thumb.Basename(photoPath, "big"))
-	smallThumbPath := path.Join(thumbsPath, thumb.Basename(photoPath, "small"))
+// ResizeJob prepares rendering a photo into outPath, which must be named
+// after its CurrentHash, fitting it within width x height (0 leaves a
+// dimension unconstrained) or covering it if crop is set, around the photo
+// focus, without upscaling, and with the watermark if the photo is to have
+// it. The format follows the extension of outPath.
+func (g *Generator) ResizeJob(photo Photo, outPath string, width, height int, crop bool) *Job {
+	return g.job(photo.Hash, photo.Path, outPath, Options{
+		Width:   width,
+		Height:  height,
+		Crop:    crop,
+		Focus:   photo.Focus,
+		Quality: imageQuality,
 
-	err = generateThumb(photoPath, bigThumbPath, bigThumbSize, false)
-	if err == nil {
-		smallThumbPhotoPath = bigThumbPath // create small thumb from big for speed
-	} else {
-		log.Println("Failed to create", bigThumbPath, "for", photoPath, "with error:", err)
+		Watermark: g.watermark(photo, ""),
+	})
+}
+
+// ThumbJob prepares rendering the thumb of a photo with the named profile in
+// a format, where "" stands for the profile format. The thumb is named after
+// the current contents of the photo.
+func (g *Generator) ThumbJob(photo Photo, name, format string) (*Job, error) {
+	profile, ok := g.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown thumb profile %q", name)
 	}
 
-	err = generateThumb(smallThumbPhotoPath, smallThumbPath, smallThumbSize, true)
+	var err error
+	if photo.Hash, err = g.CurrentHash(photo); err != nil {
+		return nil, err
+	}
+
+	basename, _ := g.Basename(photo, name, format)
+	thumbPath := path.Join(g.Dir, thumb.Path(basename))
+
+	return g.job(photo.Hash, g.source(photo, profile), thumbPath, Options{
+		Width:        profile.Size,
+		Height:       profile.Size,
+		Crop:         profile.Crop != "",
+		Gravity:      profile.Crop,
+		Focus:        photo.Focus,
+		Upscale:      profile.Upscale,
+		Quality:      profile.Quality,
+		Sharpen:      profile.Sharpen,
+		KeepMetadata: profile.KeepMetadata,
+		KeepProfile:  profile.Color == "keep",
+		Watermark:    g.watermark(photo, name),
+	}), nil
+}
+
+// Thumb creates the thumb of a photo with the named profile in a format,
+// where "" stands for the profile format, unless it is up to date, and
+// returns its path
+func (g *Generator) Thumb(ctx context.Context, photo Photo, name, format string) (string, error) {
+	j, err := g.ThumbJob(photo, name, format)
 	if err != nil {
-		log.Println("Failed to create", smallThumbPath, "for", photoPath, "with error:", err)
+		basename, _ := g.Basename(photo, name, format)
+		return path.Join(g.Dir, thumb.Path(basename)), err
+	}
+	return j.Path, g.run(ctx, j)
+}
+
+// renditions returns the versions of a photo to render thumbs of: the photo
+// itself and, if it is shared and shares are watermarked, the photo with the
+// watermark
+func (g *Generator) renditions(photo Photo) []Photo {
+	photos := []Photo{photo}
+	if photo.shared && g.Watermark != nil && g.Watermark.Shares {
+		photo.Watermark = true
+		photos = append(photos, photo)
+	}
+	return photos
+}
+
+func generateThumbs(ctx context.Context, g *Generator, photo Photo) (err error) {
+	for _, rendition := range g.renditions(photo) {
+		for _, name := range g.ProfileNames() {
+			for _, format := range append([]string{""}, g.Variants(name)...) {
+				thumbPath, thumbErr := g.Thumb(ctx, rendition, name, format)
+				if thumbErr != nil {
+					log.Println("Failed to create", thumbPath, "for", photo.Path, "with error:", thumbErr)
+					err = thumbErr
+				}
+				if ctx.Err() != nil { // the rest would fail too
+					return
+				}
+			}
+		}
 	}
 
 	return
 }
 
-func Generate(thymePath string) {
-	var photosCount int
+// GenerateOptions narrow down or widen what Generate does
+type GenerateOptions struct {
+	Force       bool   // regenerate thumbs that are up to date
+	Only        string // name or id of the only set to generate thumbs of
+	RetryFailed bool   // retry photos that failed before and have not changed
+	Workers     int    // photos to work on at the same time, if not configured
+	LowPriority bool   // yield CPU and disk to other processes
+	JSON        bool   // report progress as JSON events instead of a bar
+}
+
+// selectPhotos returns the photos to generate thumbs of, in all sets or in
+// the one named or numbered by opts.Only, and how many were skipped because
+// they failed before. They are read up front because sqlite would not let
+// workers record thumbs while a query is open. Photos scanned before content
+// hashes were kept are hashed.
+func selectPhotos(db *sql.DB, opts GenerateOptions) ([]Photo, int, error) {
+	query := `
+	SELECT path, photos.content_hash, photos.width * photos.height,
+	focal_points.focal_x, focal_points.focal_y,
+	EXISTS (
+		SELECT 1 FROM shares
+		WHERE (shares.set_id = photos.set_id OR shares.photo_id = photos.id)
+		AND shares.revoked_at IS NULL
+		AND (shares.expires_at IS NULL OR shares.expires_at > datetime('now'))
+	),
+	photos.blurhash IS NOT NULL,
+	thumb_status.status = 'failed' AND thumb_status.content_hash = photos.content_hash
+	FROM photos
+	JOIN sets ON photos.set_id = sets.id
+	LEFT JOIN focal_points ON focal_points.content_hash = photos.content_hash
+	LEFT JOIN thumb_status ON thumb_status.photo_path = photos.path
+	`
+	var args []interface{}
+
+	if only := opts.Only; only != "" {
+		var setId int
+		err := db.QueryRow("SELECT id FROM sets WHERE name = ? OR id = ?", only, only).Scan(&setId)
+		if err == sql.ErrNoRows {
+			return nil, 0, fmt.Errorf("no such set: %s", only)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		query += "WHERE sets.id = ?\n"
+		args = append(args, setId)
+	}
+
+	rows, err := db.Query(query+"ORDER BY sets.taken_at DESC, photos.taken_at ASC", args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var photos []Photo
+	var unhashed []int
+	var skipped int
+	for rows.Next() {
+		var photo Photo
+		var contentHash sql.NullString
+		var focalX, focalY sql.NullFloat64
+		var failed sql.NullBool
+		err := rows.Scan(&photo.Path, &contentHash, &photo.Pixels, &focalX, &focalY,
+			&photo.shared, &photo.placeholder, &failed)
+		if err != nil {
+			return nil, 0, err
+		}
+		if focalX.Valid && focalY.Valid {
+			photo.Focus = &thumb.Focus{X: focalX.Float64, Y: focalY.Float64}
+		}
+		if failed.Bool && !opts.RetryFailed {
+			skipped++
+			continue
+		}
+		if !contentHash.Valid {
+			unhashed = append(unhashed, len(photos))
+		}
+		photo.Hash = contentHash.String
+		photos = append(photos, photo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	for _, i := range unhashed {
+		hash, err := thumb.HashFile(photos[i].Path)
+		if err != nil {
+			return nil, 0, err
+		}
+		_, err = db.Exec("UPDATE photos SET content_hash = ? WHERE path = ?", hash, photos[i].Path)
+		if err != nil {
+			return nil, 0, err
+		}
+		photos[i].Hash = hash
+	}
+
+	return photos, skipped, nil
+}
+
+func Generate(thymePath string, opts GenerateOptions) {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	dbPath := path.Join(os.Getenv("HOME"), ".thyme.db")
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := database.Open(cfg.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	rows, err := db.Query(`
-	SELECT path FROM photos
-	JOIN sets ON photos.set_id = sets.id
-	ORDER BY sets.taken_at DESC, photos.taken_at ASC
-	`)
+	thumbnailer, err := NewThumbnailer(cfg.Thumbnailer)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer rows.Close()
 
-	err = db.QueryRow("SELECT COUNT(*) FROM photos").Scan(&photosCount)
+	reporter := progress.New(opts.JSON)
+	reporter.Start("thumbs", 0)
+
+	reporter.Phase("select", 0) // may hash photos
+	photos, skipped, err := selectPhotos(db, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	thumbsPath, err = filepath.Abs(path.Join(thymePath, thumbsDir))
+	thumbsPath, err := filepath.Abs(path.Join(thymePath, thumbsDir))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -99,42 +450,82 @@ func Generate(thymePath string) {
 		log.Fatal(err)
 	}
 
+	g := &Generator{
+		Dir:         thumbsPath,
+		Thumbnailer: thumbnailer,
+		Profiles:    cfg.ThumbProfiles,
+		DB:          db,
+		Force:       opts.Force,
+		Timeout:     time.Duration(cfg.ThumbTimeout) * time.Second,
+		Watermark:   cfg.Watermark,
+	}
+
+	workers := cfg.ThumbWorkers
+	if opts.Workers > 0 {
+		workers = opts.Workers
+	}
+
+	if opts.LowPriority || cfg.ThumbLowPriority {
+		if err := lowerPriority(); err != nil {
+			log.Print("Cannot lower priority: ", err)
+		}
+	}
+
+	log.Printf("Using the %s thumbnailer with %d workers", thumbnailer, workers)
+
 	// log to file because a progress bar is going to be rendered
-	logFile, err := os.Create("thyme-generate-thumbs.log")
+	logFile, err := os.Create(logFileName)
 	if err == nil {
 		log.SetOutput(logFile)
 	}
 	defer logFile.Close()
 
-	ch := make(chan string)
+	var failed int64
+	ch := make(chan Photo)
 	wg := sync.WaitGroup{}
-	bar := pb.StartNew(photosCount)
+	reporter.Phase("generate", len(photos))
+
+	// workers hold a share of the memory limit proportional to the size of
+	// their photo, so that large panoramas are not decoded all at once
+	memoryLimit := int64(cfg.ThumbMemory) * bytesPerMegaByte
+	memory := semaphore.NewWeighted(memoryLimit)
 
 	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
-			for photoPath := range ch {
-				generateThumbs(photoPath)
-				bar.Increment()
+			for photo := range ch {
+				weight := min(max(photo.Pixels*bytesPerPixel, 1), memoryLimit)
+				memory.Acquire(context.Background(), weight)
+
+				if err := g.Generate(context.Background(), photo); err != nil {
+					atomic.AddInt64(&failed, 1)
+					reporter.Failed(photo.Path, err)
+				} else {
+					reporter.Processed(photo.Path)
+				}
+				memory.Release(weight)
 			}
 
 			wg.Done()
 		}()
 	}
 
-	for rows.Next() {
-		var photoPath string
-		if err := rows.Scan(&photoPath); err != nil {
-			log.Fatal(err)
-		}
-		ch <- photoPath
+	for _, photo := range photos {
+		ch <- photo
 	}
 
 	close(ch)
 	wg.Wait()
 
-	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+	reporter.Finish()
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "Failed to create thumbs for %d of %d photos, see %s\n",
+			failed, len(photos), logFileName)
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d photos that failed before, retry them with -retry-failed\n",
+			skipped)
 	}
 
 	// Remove empty log file
@@ -0,0 +1,208 @@
+package thumbs
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const vipsCommand = "vipsthumbnail"
+
+type vipsThumbnailer struct{}
+
+// vipsSize formats a bounding box for vipsthumbnail, where 0 leaves a
+// dimension unconstrained
+func vipsSize(width, height int, upscale bool) string {
+	var size string
+	if width > 0 {
+		size = strconv.Itoa(width)
+	}
+	size += "x"
+	if height > 0 {
+		size += strconv.Itoa(height)
+	}
+	if !upscale {
+		size += ">"
+	}
+	return size
+}
+
+// vipsSaveOpts returns the save options for the output format, chosen by
+// vips from the file extension
+func vipsSaveOpts(dstPath string, opts Options) string {
+	saveOpts := fmt.Sprintf("Q=%d", opts.Quality)
+	if ext := filepath.Ext(dstPath); ext == ".jpg" || ext == ".jpeg" {
+		saveOpts += ",no_subsample"
+	}
+	if opts.KeepProfile && !opts.KeepMetadata {
+		saveOpts += ",keep=icc"
+	} else if !opts.KeepMetadata {
+		saveOpts += ",strip" // untagged thumbs are taken to be sRGB
+	}
+	return "[" + saveOpts + "]"
+}
+
+// runVips runs a vips command, killing it if ctx is done before it exits
+func runVips(ctx context.Context, command string, args ...string) error {
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.WaitDelay = time.Second // in case it left children holding the output open
+
+	output, err := cmd.CombinedOutput()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%s: %w", command, ctxErr)
+	}
+	if err != nil && len(output) > 0 {
+		return fmt.Errorf("%s: %v: %s", command, err, output)
+	}
+	return err
+}
+
+// vipsField returns an integer field of the header of an image, e.g. its
+// width
+func vipsField(ctx context.Context, path, field string) (int, error) {
+	output, err := exec.CommandContext(ctx, "vipsheader", "-f", field, path).Output()
+	if err != nil {
+		return 0, fmt.Errorf("vipsheader: %w", err)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(output)))
+}
+
+// vipsWatermark overlays a watermark on the image in srcPath and saves the
+// result to dstPath, which may carry save options
+func vipsWatermark(ctx context.Context, srcPath, dstPath string, wm *Mark) error {
+	width, err := vipsField(ctx, srcPath, "width")
+	if err != nil {
+		return err
+	}
+	height, err := vipsField(ctx, srcPath, "height")
+	if err != nil {
+		return err
+	}
+
+	mark, pos, err := watermarkMark(wm, width, height)
+	if err != nil {
+		return err
+	}
+
+	markPath := srcPath + ".mark.png"
+	f, err := os.Create(markPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(markPath)
+	err = png.Encode(f, mark)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// compositing adds an alpha band, which the base photo does not need
+	composited := srcPath + ".mark.v"
+	defer os.Remove(composited)
+	err = runVips(ctx, "vips", "composite2", srcPath, markPath, composited, "over",
+		"--x", strconv.Itoa(pos.X), "--y", strconv.Itoa(pos.Y))
+	if err != nil {
+		return err
+	}
+	return runVips(ctx, "vips", "flatten", composited, dstPath)
+}
+
+func (vipsThumbnailer) Thumbnail(ctx context.Context, srcPath, dstPath string, opts Options) error {
+	// vipsthumbnail resolves a relative output path against the directory
+	// of the photo, so all paths given to vips are absolute
+	srcPath, err := filepath.Abs(srcPath)
+	if err != nil {
+		return err
+	}
+	dstPath, err = filepath.Abs(dstPath)
+	if err != nil {
+		return err
+	}
+
+	size := vipsSize(opts.Width, opts.Height, opts.Upscale)
+
+	// vipsthumbnail can neither crop around a given point nor sharpen, so
+	// these steps follow it, going through files in the vips format, which
+	// keep everything
+	var steps [][]string
+
+	if opts.Crop && opts.Focus != nil {
+		width, height, err := imageSize(srcPath)
+		if err != nil {
+			return err
+		}
+
+		// resize to cover the bounding box and crop around the focus
+		scale := scaleFactor(width, height, opts)
+		scaled := image.Pt(max(1, int(math.Round(float64(width)*scale))),
+			max(1, int(math.Round(float64(height)*scale))))
+		size = fmt.Sprintf("%dx%d!", scaled.X, scaled.Y)
+
+		rect := cropRect(scaled, opts.Width, opts.Height, *opts.Focus)
+		steps = append(steps, []string{"crop", strconv.Itoa(rect.Min.X), strconv.Itoa(rect.Min.Y),
+			strconv.Itoa(rect.Dx()), strconv.Itoa(rect.Dy())})
+	}
+
+	if opts.Sharpen {
+		steps = append(steps, []string{"sharpen"})
+	}
+
+	vipsOpts := []string{
+		"--rotate",
+		"--size", size,
+		"--interpolator", "bicubic",
+	}
+
+	if opts.Crop && opts.Focus == nil {
+		gravity := opts.Gravity
+		if gravity == "" {
+			gravity = "centre"
+		}
+		vipsOpts = append(vipsOpts, "--smartcrop", gravity)
+	}
+
+	if !opts.KeepProfile {
+		vipsOpts = append(vipsOpts, "--export-profile", "srgb")
+	}
+
+	// the output of each command is the input of the next, and of the
+	// watermark if there is one
+	outPaths := make([]string, len(steps)+1)
+	for i := range outPaths {
+		outPaths[i] = fmt.Sprintf("%s.%d.v", dstPath, i)
+		defer os.Remove(outPaths[i])
+	}
+	savePath := dstPath + vipsSaveOpts(dstPath, opts)
+	if opts.Watermark == nil {
+		outPaths[len(steps)] = savePath
+	}
+
+	vipsOpts = append(vipsOpts, "--output", outPaths[0])
+	if err := runVips(ctx, vipsCommand, append([]string{srcPath}, vipsOpts...)...); err != nil {
+		return err
+	}
+
+	for i, step := range steps {
+		args := append([]string{step[0], outPaths[i], outPaths[i+1]}, step[1:]...)
+		if err := runVips(ctx, "vips", args...); err != nil {
+			return err
+		}
+	}
+
+	if opts.Watermark != nil {
+		return vipsWatermark(ctx, outPaths[len(steps)], savePath, opts.Watermark)
+	}
+	return nil
+}
+
+func (vipsThumbnailer) String() string { return "vips" }
@@ -0,0 +1,164 @@
+package thumbs
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/agorf/thyme-backend/config"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Mark is a watermark to overlay, whose image is decoded, or whose font is
+// parsed, once for all the thumbs a generator renders
+type Mark struct {
+	*config.Watermark
+
+	once sync.Once
+	src  image.Image    // the decoded image
+	font *opentype.Font // to render the text with
+	err  error
+}
+
+func (wm *Mark) load() error {
+	wm.once.Do(func() {
+		if wm.Image == "" {
+			wm.font, wm.err = opentype.Parse(goregular.TTF)
+			return
+		}
+
+		f, err := os.Open(wm.Image)
+		if err != nil {
+			wm.err = err
+			return
+		}
+		defer f.Close()
+
+		wm.src, _, wm.err = image.Decode(f)
+	})
+	return wm.err
+}
+
+// textMark renders the text of a watermark at most width x height, in white
+// with a dark shadow, so it shows on light and dark photos alike. It is drawn
+// at the size it is overlaid at rather than scaled, which would blur it.
+func textMark(f *opentype.Font, text string, width, height int) (*image.NRGBA, error) {
+	// fonts scale linearly, so a size to fill the width is found by measuring
+	// the text at a reference size
+	const refSize = 100
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: refSize, DPI: 72})
+	if err != nil {
+		return nil, err
+	}
+	refWidth := float64(font.MeasureString(face, text)) / 64
+	refMetrics := face.Metrics()
+	face.Close()
+
+	size := refSize * float64(width) / max(1, refWidth)
+	if refHeight := float64(refMetrics.Height) / 64; size*refHeight/refSize > float64(height) {
+		size = refSize * float64(height) / refHeight // a long text on a narrow thumb
+	}
+
+	if face, err = opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72}); err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	shadow := max(1, int(math.Round(size/16)))
+	mark := image.NewNRGBA(image.Rect(0, 0,
+		max(1, font.MeasureString(face, text).Ceil()+shadow),
+		max(1, metrics.Height.Ceil()+shadow)))
+
+	d := font.Drawer{Dst: mark, Face: face}
+	for _, c := range []struct {
+		color  color.Color
+		offset int
+	}{{color.Black, shadow}, {color.White, 0}} {
+		d.Src = image.NewUniform(c.color)
+		d.Dot = fixed.Point26_6{X: fixed.I(c.offset), Y: metrics.Ascent + fixed.I(c.offset)}
+		d.DrawString(text)
+	}
+
+	return mark, nil
+}
+
+// imageMark scales the image of a watermark to width, or to at most height
+func imageMark(src image.Image, width, height int) *image.NRGBA {
+	b := src.Bounds()
+	markWidth := width
+	markHeight := max(1, int(math.Round(float64(markWidth)*float64(b.Dy())/float64(b.Dx()))))
+	if markHeight > height { // a tall mark on a wide thumb
+		markWidth = max(1, markWidth*height/markHeight)
+		markHeight = height
+	}
+
+	mark := image.NewNRGBA(image.Rect(0, 0, markWidth, markHeight))
+	draw.CatmullRom.Scale(mark, mark.Rect, src, b, draw.Src, nil)
+	return mark
+}
+
+// watermarkMark returns the watermark as overlaid on a thumb of width x
+// height, with its opacity applied, and where its top left corner goes
+func watermarkMark(wm *Mark, width, height int) (*image.NRGBA, image.Point, error) {
+	if err := wm.load(); err != nil {
+		return nil, image.Point{}, err
+	}
+
+	var mark *image.NRGBA
+	scaledWidth := max(1, int(math.Round(wm.Scale*float64(width))))
+	if wm.src != nil {
+		mark = imageMark(wm.src, scaledWidth, height)
+	} else {
+		var err error
+		if mark, err = textMark(wm.font, wm.Text, scaledWidth, height); err != nil {
+			return nil, image.Point{}, err
+		}
+	}
+
+	for i := 3; i < len(mark.Pix); i += 4 {
+		mark.Pix[i] = uint8(math.Round(float64(mark.Pix[i]) * wm.Opacity))
+	}
+
+	markWidth, markHeight := mark.Rect.Dx(), mark.Rect.Dy()
+	margin := min(width, height) / 40
+	left, top := margin, margin
+	right, bottom := width-markWidth-margin, height-markHeight-margin
+
+	var pos image.Point
+	switch wm.Position {
+	case "centre":
+		pos = image.Pt((width-markWidth)/2, (height-markHeight)/2)
+	case "top-left":
+		pos = image.Pt(left, top)
+	case "top-right":
+		pos = image.Pt(right, top)
+	case "bottom-left":
+		pos = image.Pt(left, bottom)
+	default:
+		pos = image.Pt(right, bottom)
+	}
+	pos.X, pos.Y = max(pos.X, 0), max(pos.Y, 0)
+
+	return mark, pos, nil
+}
+
+// overlayWatermark returns a copy of img with the watermark drawn over it
+func overlayWatermark(img image.Image, wm *Mark) (image.Image, error) {
+	b := img.Bounds()
+	mark, pos, err := watermarkMark(wm, b.Dx(), b.Dy())
+	if err != nil {
+		return nil, err
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, img, b.Min, draw.Src)
+	draw.Draw(dst, mark.Rect.Add(pos), mark, image.Point{}, draw.Over)
+	return dst, nil
+}
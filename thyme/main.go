@@ -1,12 +1,14 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
 	"github.com/agorf/thyme-backend/photos"
 	"github.com/agorf/thyme-backend/server"
 	"github.com/agorf/thyme-backend/thumbs"
+	"github.com/agorf/thyme-backend/users"
 )
 
 const helpText = `NAME:
@@ -16,10 +18,51 @@ USAGE:
     thyme command [arguments...]
 
 COMMANDS:
-    scan   <path>...  import photo metadata into database
-    thumbs <path>     generate photo thumbs (under <path>/public/thumbs)
-    run    [<path>]   run web server (rooted at <path>/public)
-`
+    scan   [-json] <path>...
+                      import photo metadata into database
+    thumbs [-force] [-only <set>] [-retry-failed] [-workers <n>]
+           [-low-priority] [-json] <path>
+                      generate missing or outdated photo thumbs (under
+                      <path>/public/thumbs), or all with -force, skipping
+                      photos that failed before unless -retry-failed
+    thumbs gc [-dry-run] <path>
+                      remove (or list) thumbs of photos no longer in the
+                      database and of old thumb profiles
+    thumbs migrate <path>
+                      move thumbs into the sharded directory layout
+    duplicates [-threshold <n>] [-keep-best] [-json]
+                      list groups of exact copies and of near-duplicates
+                      (whose difference hashes differ in at most <n> bits,
+                      default 10), hiding all but the largest photo of each
+                      with -keep-best
+    duplicates -unhide
+                      show photos hidden as duplicates again
+    run    [options] [<path>]
+                      run web server (rooted at <path>/public)
+    user   add [-admin] <name>
+    user   remove|passwd|admin|unadmin <name>
+                      manage users (passwords are read from stdin)
+    user   token <name> [<label>]
+                      create and print an API token for user
+    group  add|remove <group>
+    group  join|leave <group> <user>
+                      manage groups that sets can be shared with
+
+RUN OPTIONS:
+    -listen <address>   listen on TCP address (default 127.0.0.1:9292)
+    -socket <path>      listen on Unix domain socket instead
+    -tls-cert <file>    serve HTTPS using certificate (reloaded on change)
+    -tls-key <file>     private key for -tls-cert
+
+    Options can also be set in ~/.thyme.json (or $THYME_CONFIG) as "listen",
+    "socket", "tls_cert" and "tls_key". A socket passed by systemd socket
+    activation takes precedence.
+
+    Set "auth": true in the configuration to require users to log in. API
+    tokens are passed in an "Authorization: Bearer <token>" header.
+
+    The server reloads its configuration and reopens the database on SIGHUP
+    and shuts down gracefully on SIGINT or SIGTERM.`
 
 func main() {
 	var cmd string
@@ -35,23 +78,139 @@ func main() {
 
 	switch cmd {
 	case "scan":
-		if len(args) == 0 {
+		var opts photos.ScanOptions
+
+		flags := flag.NewFlagSet("scan", flag.ExitOnError)
+		flags.BoolVar(&opts.JSON, "json", false, "report progress as JSON events")
+		flags.Parse(args)
+
+		if flags.NArg() == 0 {
 			fmt.Fprintln(os.Stderr, "no paths specified")
 			os.Exit(1)
 		}
-		photos.Scan(args...)
+		photos.Scan(opts, flags.Args()...)
 	case "thumbs":
-		if len(args) == 0 {
+		if len(args) > 0 && args[0] == "gc" {
+			flags := flag.NewFlagSet("thumbs gc", flag.ExitOnError)
+			dryRun := flags.Bool("dry-run", false, "list files instead of removing them")
+			flags.Parse(args[1:])
+
+			if flags.NArg() == 0 {
+				fmt.Fprintln(os.Stderr, "no path specified")
+				os.Exit(1)
+			}
+			thumbs.GC(flags.Arg(0), *dryRun)
+			return
+		}
+
+		if len(args) > 0 && args[0] == "migrate" {
+			if len(args) < 2 {
+				fmt.Fprintln(os.Stderr, "no path specified")
+				os.Exit(1)
+			}
+			thumbs.Migrate(args[1])
+			return
+		}
+
+		var opts thumbs.GenerateOptions
+
+		flags := flag.NewFlagSet("thumbs", flag.ExitOnError)
+		flags.BoolVar(&opts.Force, "force", false, "regenerate all thumbs")
+		flags.StringVar(&opts.Only, "only", "", "generate thumbs of `set` (name or id) only")
+		flags.BoolVar(&opts.RetryFailed, "retry-failed", false, "retry photos that failed before")
+		flags.IntVar(&opts.Workers, "workers", 0, "work on `n` photos at the same time (default thumb_workers)")
+		flags.BoolVar(&opts.LowPriority, "low-priority", false, "yield CPU and disk to other processes")
+		flags.BoolVar(&opts.JSON, "json", false, "report progress as JSON events")
+		flags.Parse(args)
+
+		if flags.NArg() == 0 {
 			fmt.Fprintln(os.Stderr, "no path specified")
 			os.Exit(1)
 		}
-		thumbs.Generate(args[0])
+		thumbs.Generate(flags.Arg(0), opts)
+	case "duplicates":
+		var opts photos.DuplicatesOptions
+
+		flags := flag.NewFlagSet("duplicates", flag.ExitOnError)
+		flags.IntVar(&opts.Threshold, "threshold", photos.DefaultDuplicateThreshold,
+			"group photos whose difference hashes differ in at most `n` bits")
+		flags.BoolVar(&opts.KeepBest, "keep-best", false, "hide all but the largest photo of each group")
+		flags.BoolVar(&opts.Unhide, "unhide", false, "show all hidden photos again")
+		flags.BoolVar(&opts.JSON, "json", false, "list groups as JSON")
+		flags.Parse(args)
+
+		photos.Duplicates(opts)
 	case "run":
+		var opts server.Options
+
+		flags := flag.NewFlagSet("run", flag.ExitOnError)
+		flags.StringVar(&opts.ListenAddr, "listen", "", "listen on TCP `address`")
+		flags.StringVar(&opts.SocketPath, "socket", "", "listen on Unix domain socket at `path`")
+		flags.StringVar(&opts.TLSCertPath, "tls-cert", "", "TLS certificate `file`")
+		flags.StringVar(&opts.TLSKeyPath, "tls-key", "", "TLS private key `file`")
+		flags.Parse(args)
+
 		thymePath := "."
+		if flags.NArg() > 0 {
+			thymePath = flags.Arg(0)
+		}
+		server.Run(thymePath, opts)
+	case "user":
+		var subcmd string
 		if len(args) > 0 {
-			thymePath = args[0]
+			subcmd, args = args[0], args[1:]
+		}
+
+		flags := flag.NewFlagSet("user "+subcmd, flag.ExitOnError)
+		admin := flags.Bool("admin", false, "grant administrator rights")
+		flags.Parse(args)
+
+		if flags.NArg() == 0 {
+			fmt.Fprintln(os.Stderr, "no user specified")
+			os.Exit(1)
+		}
+		name := flags.Arg(0)
+
+		switch subcmd {
+		case "add":
+			users.Add(name, *admin)
+		case "remove":
+			users.Remove(name)
+		case "passwd":
+			users.Passwd(name)
+		case "admin":
+			users.SetAdmin(name, true)
+		case "unadmin":
+			users.SetAdmin(name, false)
+		case "token":
+			users.Token(name, flags.Arg(1))
+		default:
+			fmt.Println(helpText)
+		}
+	case "group":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "no group specified")
+			os.Exit(1)
+		}
+
+		switch args[0] {
+		case "add":
+			users.AddGroup(args[1])
+		case "remove":
+			users.RemoveGroup(args[1])
+		case "join", "leave":
+			if len(args) < 3 {
+				fmt.Fprintln(os.Stderr, "no user specified")
+				os.Exit(1)
+			}
+			if args[0] == "join" {
+				users.JoinGroup(args[1], args[2])
+			} else {
+				users.LeaveGroup(args[1], args[2])
+			}
+		default:
+			fmt.Println(helpText)
 		}
-		server.Run(thymePath)
 	default:
 		fmt.Println(helpText)
 	}
@@ -0,0 +1,112 @@
+package users
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+func groupId(name string) (id int64, err error) {
+	err = db.QueryRow("SELECT id FROM user_groups WHERE name = ?", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("group %q does not exist", name)
+	}
+	return
+}
+
+func AddGroup(name string) {
+	setupDatabase()
+	defer db.Close()
+
+	result, err := db.Exec("INSERT INTO user_groups (name) VALUES (?)", name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("user_groups id=%d name=%s\n", id, name)
+}
+
+func RemoveGroup(name string) {
+	setupDatabase()
+	defer db.Close()
+
+	id, err := groupId(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM user_group_members WHERE group_id = ?",
+		"DELETE FROM set_grants WHERE group_id = ?",
+		"DELETE FROM user_groups WHERE id = ?",
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("user_groups id=%d removed\n", id)
+}
+
+func JoinGroup(groupName, userName string) {
+	setupDatabase()
+	defer db.Close()
+
+	gid, err := groupId(groupName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	uid, err := userId(userName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+	INSERT OR IGNORE INTO user_group_members (group_id, user_id) VALUES (?, ?)
+	`, gid, uid)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("user_group_members group_id=%d user_id=%d\n", gid, uid)
+}
+
+func LeaveGroup(groupName, userName string) {
+	setupDatabase()
+	defer db.Close()
+
+	gid, err := groupId(groupName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	uid, err := userId(userName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+	DELETE FROM user_group_members WHERE group_id = ? AND user_id = ?
+	`, gid, uid)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("user_group_members group_id=%d user_id=%d removed\n", gid, uid)
+}
@@ -0,0 +1,242 @@
+package users
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/agorf/thyme-backend/config"
+	"github.com/agorf/thyme-backend/database"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+const tokenBytes = 32
+
+var db *sql.DB
+
+// GenerateToken returns a random hex-encoded token suitable for sessions and
+// API tokens
+func GenerateToken() (string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken returns the hash under which a token is stored, so that a leaked
+// database does not leak usable tokens
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+
+	if !term.IsTerminal(fd) { // e.g. piped in by a script
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+
+	return string(password), err
+}
+
+func promptPasswordHash() ([]byte, error) {
+	password, err := readPassword("Password: ")
+	if err != nil {
+		return nil, err
+	}
+	if password == "" {
+		return nil, errors.New("empty password")
+	}
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		confirmation, err := readPassword("Confirm password: ")
+		if err != nil {
+			return nil, err
+		}
+		if password != confirmation {
+			return nil, errors.New("passwords do not match")
+		}
+	}
+
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+func userId(name string) (id int64, err error) {
+	err = db.QueryRow("SELECT id FROM users WHERE name = ?", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("user %q does not exist", name)
+	}
+	return
+}
+
+func setupDatabase() {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err = database.Open(cfg.Database) // := here shadows global db var
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func Add(name string, admin bool) {
+	setupDatabase()
+	defer db.Close()
+
+	passwordHash, err := promptPasswordHash()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	result, err := db.Exec(`
+	INSERT INTO users (name, password_hash, admin, created_at)
+	VALUES (?, ?, ?, datetime('now'))
+	`, name, passwordHash, admin)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("users id=%d name=%s admin=%t\n", id, name, admin)
+}
+
+// SetAdmin grants or revokes administrator rights, which allow seeing all
+// sets and managing who else can see them
+func SetAdmin(name string, admin bool) {
+	setupDatabase()
+	defer db.Close()
+
+	id, err := userId(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := db.Exec("UPDATE users SET admin = ? WHERE id = ?", admin, id); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("users id=%d admin=%t\n", id, admin)
+}
+
+func Remove(name string) {
+	setupDatabase()
+	defer db.Close()
+
+	id, err := userId(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM api_tokens WHERE user_id = ?",
+		"DELETE FROM user_group_members WHERE user_id = ?",
+		"DELETE FROM set_grants WHERE user_id = ?",
+		"UPDATE sets SET owner_id = NULL WHERE owner_id = ?",
+		// the links they handed out stop working
+		"UPDATE shares SET revoked_at = COALESCE(revoked_at, datetime('now')), created_by = NULL WHERE created_by = ?",
+		"DELETE FROM users WHERE id = ?",
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("users id=%d removed\n", id)
+}
+
+// Passwd changes the password of a user and logs them out everywhere
+func Passwd(name string) {
+	setupDatabase()
+	defer db.Close()
+
+	id, err := userId(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	passwordHash, err := promptPasswordHash()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", passwordHash, id); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", id); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("users id=%d password changed\n", id)
+}
+
+// Token creates an API token for a user and prints it. Only its hash is
+// stored so it cannot be shown again.
+func Token(name, tokenName string) {
+	setupDatabase()
+	defer db.Close()
+
+	id, err := userId(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	token, err := GenerateToken()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+	INSERT INTO api_tokens (user_id, name, token_hash, created_at)
+	VALUES (?, ?, ?, datetime('now'))
+	`, id, tokenName, HashToken(token))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(token)
+}